@@ -0,0 +1,114 @@
+// Command daemonctl installs and controls any executable as a service, with
+// the init system backends of the daemon package:
+//
+//	daemonctl install --name x --exec /opt/x/bin/x -- args...
+//	daemonctl start x --exec /opt/x/bin/x
+//	daemonctl status x --output=json
+//	daemonctl apply -f x.yaml
+//	daemonctl list
+//	daemonctl restart --all
+//	daemonctl package --exec /opt/x/bin/x --format deb --version 1.0
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miaia/daemon"
+)
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "Usage: daemonctl <command> [name] [flags] [-- args]\n\nCommands:\n")
+	for _, c := range daemon.Commands(daemon.Config{}) {
+		fmt.Fprintf(w, "  %-20s%s\n", strings.TrimSpace(c.Name+" "+c.Args), c.Short)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// errUsage is returned after the usage was printed for bad arguments
+var errUsage = errors.New("usage")
+
+// installs are the verbs that install the service when it is not installed
+var installs = map[string]bool{"install": true, "start": true, "scale": true}
+
+func main() {
+	err := run(daemon.Config{AutoStart: true}, os.Args[1:])
+	if err == errUsage {
+		os.Exit(daemon.ExitUsage)
+	}
+	os.Exit(daemon.ExitCode(err))
+}
+
+// run runs the daemonctl command line args, conf holds the defaults the
+// flags override
+func run(conf daemon.Config, args []string) error {
+	fs := flag.NewFlagSet("daemonctl", flag.ContinueOnError)
+	daemon.Flags(fs, &conf)
+	fs.StringVar(&conf.Exec, "exec", "", "program the service runs, the service is named after it by default")
+	fs.StringVar(&conf.User, "user", "", "user the service runs as, root by default")
+	fs.StringVar(&conf.Group, "group", "", "group the service runs as")
+	fs.BoolVar(&conf.AutoStart, "autostart", true, "start the service at boot when it is installed")
+	fs.BoolVar(&conf.Notify, "notify", false, "the program reports when it is ready, on the systemd notify socket or the s6 notification fd")
+	fs.StringVar(&conf.PreStart, "pre-start", "", "shell script the upstart job runs before every start")
+	fs.DurationVar(&conf.KillTimeout, "kill-timeout", 0, "how long upstart waits after SIGTERM before it kills the program")
+	fs.Usage = func() { usage(fs) }
+
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	cmd := args[0]
+	var file string
+	var p daemon.Package
+	switch cmd {
+	case "apply":
+		fs.StringVar(&file, "f", "", "manifest file, YAML or JSON, its exec names the program")
+	case "package":
+		daemon.PackageFlags(fs, &p)
+	}
+
+	// The service name may come first, "daemonctl status x"
+	args = args[1:]
+	if cmd != "apply" && cmd != "list" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		conf.Name, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return errUsage
+	}
+	args = fs.Args()
+
+	// The verbs that may install the service need the program, without it
+	// the daemon package would install daemonctl itself
+	switch {
+	case cmd == "apply":
+		// apply reports a manifest it cannot read
+		if m, err := daemon.ReadManifest(file); err == nil && m.Exec == "" && conf.Exec == "" {
+			return usageError(fs, fmt.Errorf("%s names no program, exec", file))
+		}
+		args = append([]string{file}, args...)
+	case conf.Exec == "" && cmd == "package":
+		return usageError(fs, fmt.Errorf("package needs the program, --exec"))
+	case conf.Exec == "" && !conf.All && installs[cmd]:
+		return usageError(fs, fmt.Errorf("%s needs the program, --exec", cmd))
+	case conf.Name == "" && conf.Exec == "" && cmd != "list" && !conf.All:
+		return usageError(fs, fmt.Errorf("%s needs the service name or --exec", cmd))
+	}
+	if cmd == "package" {
+		args = append(p.Args(), args...)
+	}
+	return daemon.RunCommand(conf, cmd, args)
+}
+
+func usageError(fs *flag.FlagSet, err error) error {
+	fmt.Fprintln(fs.Output(), err)
+	fs.Usage()
+	return errUsage
+}
@@ -0,0 +1,44 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miaia/daemon"
+	"github.com/miaia/daemon/daemontest"
+)
+
+func TestRestartInstalled(t *testing.T) {
+	sys, err := daemontest.New(t.TempDir(), daemontest.Systemd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := sys.Config(daemon.Config{AutoStart: true, Quiet: true, Timeout: 200 * time.Millisecond})
+	if err := run(conf, []string{"start", "app", "--exec", "/opt/app/bin/app"}); err != nil {
+		t.Fatalf("start: %v, commands: %v", err, sys.Calls())
+	}
+
+	// restart controls the installed service, it needs no --exec
+	if err := run(conf, []string{"restart", "app"}); err != nil {
+		t.Fatalf("restart: %v, commands: %v", err, sys.Calls())
+	}
+	if !sys.Running("app") {
+		t.Errorf("app not running after restart, commands: %v", sys.Calls())
+	}
+	calls := sys.Calls()
+	restarted := false
+	for _, c := range calls {
+		restarted = restarted || len(c) == 3 && c[0] == "systemctl" && c[1] == "restart" && c[2] == "app"
+	}
+	if !restarted {
+		t.Errorf("no systemctl restart app in %v", calls)
+	}
+
+	// The verbs that install still need the program
+	if err := run(conf, []string{"install", "other"}); err != errUsage {
+		t.Errorf("install without --exec: %v, want the usage error", err)
+	}
+}
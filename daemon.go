@@ -2,44 +2,569 @@ package daemon
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var (
 	errPermit    = errors.New("You must have root privileges")
 	errNoInstall = errors.New("Service is not installed")
-	errStopped   = errors.New("stopped")
+	errInstance  = errors.New("Instance name may only contain letters, digits, '.', '_' and '-'")
+	errName      = errors.New("Service name must be 1 to 200 printable characters without '/'")
+	errDescrip   = errors.New("Service display name and description may not contain control characters")
+	errRunning   = errors.New("not running")
+	errNotOwned  = errors.New("Service was not installed by this package, use --force to replace or remove it")
+	errOffline   = errors.New("No init system runs in the root, the service can only be installed, enabled or disabled")
 )
 
+// Exit codes of RunDaemon. status follows the LSB codes of the status action,
+// the other verbs the LSB codes of the other init script actions.
+const (
+	ExitOK           = 0
+	ExitFailure      = 1
+	ExitUsage        = 2
+	ExitNotRunning   = 3
+	ExitUnknown      = 4 // status is unknown, or privileges are insufficient
+	ExitNotInstalled = 5
+)
+
+// codeError is an error with the exit code it maps to
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string { return e.err.Error() }
+
+func (e *codeError) Unwrap() error { return e.err }
+
+// ExitCode returns the exit code for an error returned by Execute, apps
+// that run the verbs themselves can end with os.Exit(daemon.ExitCode(err))
+func ExitCode(err error) int {
+	var cerr *codeError
+	switch {
+	case err == nil, err == flag.ErrHelp:
+		return ExitOK
+	case errors.As(err, &cerr):
+		return cerr.code
+	case errors.Is(err, errPermit):
+		return ExitUnknown
+	case errors.Is(err, errNoInstall):
+		return ExitNotInstalled
+	}
+	return ExitFailure
+}
+
+// The service definitions set these variables for the process they start
+const (
+	serviceEnv  = "DAEMON_SERVICE"
+	instanceEnv = "DAEMON_INSTANCE"
+)
+
+var instanceRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Config holds the settings used to install and control the service.
+type Config struct {
+	// Name of the service, by default the binary name. Characters the init
+	// system does not accept are escaped, systemd-escape style for systemd
+	// and replaced by '_' elsewhere.
+	Name string
+	// DisplayName is shown by service managers that have one, like the
+	// Windows services console. It defaults to Name.
+	DisplayName string
+	// Description of the service, by default "<binary> server daemon".
+	Description string
+	// Exec is the program the service runs, by default the running binary.
+	// Set it to run another executable, like a third party tool, as a
+	// service.
+	Exec string
+	// Command is the subcommand the service verbs live under, with "service"
+	// they are run as "./app service start". Empty keeps the old behaviour
+	// of taking the verb from the last argument.
+	Command string
+	// AutoStart makes the init system start the service at boot.
+	AutoStart bool
+	// User and Group the service runs as, root when empty
+	User  string
+	Group string
+	// Env is added to the environment of the service process
+	Env map[string]string
+	// Limits are the resource limits of the service process
+	Limits Limits
+	// Hardening restricts what the service process may do
+	Hardening Hardening
+	// Notify tells the init system the app calls Ready once it serves, start
+	// then waits for that. systemd units get Type=notify and s6 services a
+	// notification-fd, the other init systems ignore it.
+	Notify bool
+	// PreStart is a shell script run as User before every start of the
+	// service, a failing PreStart keeps it from starting. KillTimeout is how
+	// long stop waits after SIGTERM before the service is killed, the init
+	// system default when zero. NormalExit are the exit codes besides 0 that
+	// end the service without a restart. Only upstart supports these, the
+	// other init systems ignore them.
+	PreStart    string
+	KillTimeout time.Duration
+	NormalExit  []int
+	// Runit sets where runit services are defined and supervised
+	Runit Runit
+	// S6 sets where s6 services are defined and supervised
+	S6 S6
+	// Supervisor sets where supervisord reads the program from
+	Supervisor Supervisor
+	// Instance selects one named instance of the service. systemd runs all
+	// instances from a single <name>@.service template unit, the other init
+	// systems get one service per instance named <name>@<instance>.
+	Instance string
+	// Timeout is how long start, stop and restart wait for the service to
+	// reach the new state, 10 seconds when zero. A negative Timeout does not
+	// wait.
+	Timeout time.Duration
+	// LockTimeout is how long a command waits while another process changes
+	// the same service, 30 seconds when zero. A negative LockTimeout fails
+	// at once.
+	LockTimeout time.Duration
+	// LogLines is the number of log lines reported when the service does not
+	// reach the new state, 10 when zero.
+	LogLines int
+	// Quiet drops the human readable output of the verbs, errors included,
+	// the exit code tells the result
+	Quiet bool
+	// Output is the format verbs print their result in, "text" or "json"
+	Output string
+	// All runs the verb on every service this package installed, see List
+	All bool
+	// Force replaces or removes service files this package did not write.
+	// Without it a name collision with a service of the system is an error.
+	Force bool
+	// Purge makes uninstall delete the logs and state of the service too,
+	// by default they are kept
+	Purge bool
+	// Root is the directory the service files are read and written under,
+	// the filesystem root when empty. Commands run with Root set need no
+	// root privileges. Without an Executor no init system runs in Root, as
+	// in an image being built: install, uninstall, enable and disable only
+	// change files, enabling with the links the init system would make, and
+	// the verbs that need a running service fail. Exec is the path of the
+	// program in Root.
+	Root string
+	// Executor runs the init system commands, like systemctl, when set. The
+	// daemontest package fakes an init system with one.
+	Executor Executor
+
+	// reinstall makes Install rewrite the files of the service it installed
+	// before in place, leaving it enabled or disabled as it is
+	reinstall bool
+}
+
+// Executor runs a command of the init system and returns its standard
+// output. A command that fails, like one exiting with a non-zero status,
+// returns an error.
+type Executor interface {
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// path returns where the file at path is under conf.Root
+func (c *Config) path(path string) string {
+	if c.Root == "" {
+		return path
+	}
+	return filepath.Join(c.Root, path)
+}
+
+// offline reports whether the service files are under a Root no init
+// system runs in, so no init system command can be run
+func (c *Config) offline() bool {
+	return c.Root != "" && c.Executor == nil
+}
+
+// output runs the command name with Executor and returns its output
+func (c *Config) output(name string, args ...string) ([]byte, error) {
+	if c.Executor != nil {
+		return c.Executor.Run(name, args...)
+	}
+	if c.offline() {
+		return nil, errOffline
+	}
+	return exec.Command(name, args...).Output()
+}
+
+// command runs the command name with Executor
+func (c *Config) command(name string, args ...string) error {
+	_, err := c.output(name, args...)
+	return err
+}
+
+// privileged reports whether the service files may be changed, root is
+// needed unless they are under Root
+func (c *Config) privileged() bool {
+	return c.Root != "" || checkRootGroup()
+}
+
+// Limits are resource limits of the service process, zero leaves the limit
+// of the init system
+type Limits struct {
+	NoFile int `json:"nofile,omitempty"`
+	NProc  int `json:"nproc,omitempty"`
+}
+
+// Hardening restricts the service process. Only systemd supports these, the
+// other init systems ignore them.
+type Hardening struct {
+	NoNewPrivileges bool `json:"no_new_privileges,omitempty"`
+	PrivateTmp      bool `json:"private_tmp,omitempty"`
+	// ProtectSystem is "true", "full" or "strict", see systemd.exec(5)
+	ProtectSystem string `json:"protect_system,omitempty"`
+	// ProtectHome is "true", "read-only" or "tmpfs"
+	ProtectHome    string   `json:"protect_home,omitempty"`
+	ReadWritePaths []string `json:"read_write_paths,omitempty"`
+}
+
+// Runit holds the directories of a runit host. Setting ServiceDir selects
+// runit even where it is not the init system, like a runsvdir supervising
+// the services of a container.
+type Runit struct {
+	// Dir holds the service directories, /etc/sv when empty
+	Dir string
+	// ServiceDir is the directory runsvdir supervises, the services are
+	// linked into it. /var/service when it exists, as on Void Linux, and
+	// /etc/service otherwise.
+	ServiceDir string
+	// NoLog leaves out the log service writing the output to
+	// /var/log/<name> with svlogd, the output then goes to runsvdir
+	NoLog bool
+}
+
+// S6 holds the directories of an s6 host. Setting ScanDir selects s6 even
+// where it is not the init system, like an s6-svscan in a container.
+type S6 struct {
+	// Dir holds the service directories, /etc/s6/sv when empty. They carry
+	// a type file, so s6-rc can compile them as a source too.
+	Dir string
+	// ScanDir is the scan directory s6-svscan watches, the services are
+	// linked into it. /run/service when it exists, as with s6-linux-init and
+	// s6-overlay, and /service otherwise.
+	ScanDir string
+	// NoLog leaves out the log service writing the output to
+	// /var/log/<name> with s6-log, the output then goes to s6-svscan
+	NoLog bool
+}
+
+// Supervisor holds the directory supervisord includes programs from.
+// Setting ConfDir selects supervisord even where the init system is another.
+type Supervisor struct {
+	// ConfDir holds the program files, /etc/supervisor/conf.d when empty,
+	// as on Debian, or /etc/supervisord.d with .ini files where there is no
+	// /etc/supervisor, as on RHEL
+	ConfDir string
+}
+
+// user returns the user the service runs as
+func (c *Config) user() string {
+	if c.User == "" {
+		return "root"
+	}
+	return c.User
+}
+
+// group returns the group the service runs as, empty for the primary group
+// of User
+func (c *Config) group() string {
+	if c.Group == "" && c.User == "" {
+		return "root"
+	}
+	return c.Group
+}
+
+// envList returns Env as sorted KEY=VALUE pairs
+func (c *Config) envList() []string {
+	env := make([]string, 0, len(c.Env))
+	for k, v := range c.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// dquoteEscaper escapes the characters special between double quotes
+var dquoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+// dquoteUnescaper undoes dquoteEscaper
+var dquoteUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, "$", "\\`", "`")
+
+// shellWords returns args as the words of a shell command, quoted when they
+// are not plain
+func shellWords(args []string) string {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = arg
+		if arg == "" || strings.IndexFunc(arg, isShellSpecial) >= 0 {
+			words[i] = shellQuote(arg)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// shellArgs returns args as shellWords does, escaped to go between the
+// double quotes of DAEMON_ARGS="..."
+func shellArgs(args []string) string {
+	return dquoteEscaper.Replace(shellWords(args))
+}
+
+func isShellSpecial(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,+@%", r))
+}
+
+// splitShellWords splits s into words as the shell does, undoing the quotes
+// shellWords adds
+func splitShellWords(s string) []string {
+	var args []string
+	var word []rune
+	inWord, quote, escaped := false, rune(0), false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word, escaped = append(word, r), false
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			word = append(word, r)
+		case r == '\'' || r == '"':
+			inWord, quote = true, r
+		case r == '\\':
+			inWord, escaped = true, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				args, word, inWord = append(args, string(word)), word[:0], false
+			}
+		default:
+			inWord, word = true, append(word, r)
+		}
+	}
+	if inWord {
+		args = append(args, string(word))
+	}
+	return args
+}
+
+// shellArgsFromFile returns the arguments shellArgs wrote to the file at
+// path, found by the first group of re
+func shellArgsFromFile(path string, re *regexp.Regexp) []string {
+	return splitShellWords(dquoteUnescaper.Replace(matchFile(path, re)))
+}
+
+// systemdSpecials escapes the '%' of specifiers and the '$' of variables in
+// a systemd command line
+var systemdSpecials = strings.NewReplacer("%", "%%", "$", "$$")
+
+// systemdWords returns args as the words of a systemd command line, quoted
+// with C style escapes when they are not plain
+func systemdWords(args []string) string {
+	words := make([]string, len(args))
+	for i, arg := range args {
+		words[i] = arg
+		if arg == "" || strings.IndexFunc(arg, isShellSpecial) >= 0 {
+			words[i] = strconv.Quote(arg)
+		}
+	}
+	return systemdSpecials.Replace(strings.Join(words, " "))
+}
+
+// splitSystemdWords splits the command line systemdWords wrote into its
+// words
+func splitSystemdWords(s string) []string {
+	s = strings.NewReplacer("%%", "%", "$$", "$").Replace(s)
+	var args []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return args
+		}
+		end := strings.IndexAny(s, " \t")
+		if s[0] == '"' {
+			// The closing quote is the first one no backslash escapes
+			end = 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			end++
+		}
+		if end < 0 || end > len(s) {
+			end = len(s)
+		}
+		word := s[:end]
+		if uq, err := strconv.Unquote(word); err == nil {
+			word = uq
+		}
+		args, s = append(args, word), s[end:]
+	}
+}
+
+// shellEnv turns KEY=VALUE pairs into shell assignments
+func shellEnv(env []string) []string {
+	quoted := make([]string, len(env))
+	for i, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		quoted[i] = kv[0] + "=" + shellQuote(kv[1])
+	}
+	return quoted
+}
+
+// Status is the state of a service.
+type Status struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	// State is "running", "stopped" or "not-installed"
+	State   string `json:"state"`
+	Running bool   `json:"running"`
+	PID     int    `json:"pid,omitempty"`
+	Enabled bool   `json:"enabled"`
+	// Path is the unit file, init script or job the service is defined in
+	Path string   `json:"unit_path,omitempty"`
+	Args []string `json:"args,omitempty"`
+	// Version of this package that installed the service and the install
+	// time, filled in by List
+	Version   string `json:"version,omitempty"`
+	Installed string `json:"installed,omitempty"`
+}
+
+// StateError is returned when a service does not reach the wanted state
+// before Config.Timeout. ExitStatus and Logs are filled in when the init
+// system keeps them.
+type StateError struct {
+	Name       string
+	Running    bool
+	ExitStatus string
+	Logs       []string
+}
+
+func (e *StateError) Error() string {
+	want := "stopped"
+	if e.Running {
+		want = "running"
+	}
+	msg := fmt.Sprintf("%s is not %s", e.Name, want)
+	if e.ExitStatus != "" {
+		msg += ", " + e.ExitStatus
+	}
+	if len(e.Logs) > 0 {
+		msg += "\n" + strings.Join(e.Logs, "\n")
+	}
+	return msg
+}
+
+const (
+	defaultTimeout  = 10 * time.Second
+	defaultLogLines = 10
+	pollInterval    = 200 * time.Millisecond
+	// a started service must stay up this long to count as running
+	settleTime = time.Second
+)
+
+// diagnoser is implemented by the backends that can tell why a service
+// stopped, exitStatus describes how the last run ended
+type diagnoser interface {
+	diagnose(lines int) (exitStatus string, logs []string)
+}
+
+// withState sets State from Running
+func (st *Status) withState() *Status {
+	st.State = "stopped"
+	if st.Running {
+		st.State = "running"
+	}
+	return st
+}
+
 type daemon interface {
+	// describe returns the Status fields known without asking the init system
+	describe() *Status
 	IsInstalled() bool
 	Install(args ...string) error
 	UnInstall() error
 	Start() error
 	Stop() error
-	Status() error
+	Status() (*Status, error)
 	Restart() error
+	// isCurrent reports whether the installed service matches what Install
+	// would install with args
+	isCurrent(args ...string) bool
+	Enable() error
+	Disable() error
 	Run() error
 }
 
-func winServerRun() {
-	var exepath string
-	var err error
-	if exepath, err = filepath.Abs(os.Args[0]); err != nil {
-		fmt.Printf("get the %s path error %v\n", os.Args[0], err)
+// serviceNames resolves the binary path, the app name and the service name,
+// and fills in the Config defaults derived from them
+func serviceNames(conf *Config) (exepath, appName, serverName string, err error) {
+	exepath = os.Args[0]
+	if conf.Exec != "" {
+		exepath = conf.Exec
+	}
+	if exepath, err = filepath.Abs(exepath); err != nil {
+		return
+	}
+	// The service runs the program from inside Root
+	if conf.Root != "" {
+		if root, err := filepath.Abs(conf.Root); err == nil && strings.HasPrefix(exepath, root+string(filepath.Separator)) {
+			exepath = strings.TrimPrefix(exepath, root)
+		}
+	}
+	appName = filepath.Base(exepath)
+	serverName = strings.Join(strings.Fields(appName), "_")
+	if conf.Name != "" {
+		serverName = conf.Name
+	}
+	if err = validateName(serverName); err != nil {
+		return
+	}
+	if conf.Instance != "" && !instanceRe.MatchString(conf.Instance) {
+		err = errInstance
+		return
+	}
+	// The names go on one line of the service file, a newline would end it
+	if strings.IndexFunc(conf.DisplayName+conf.Description, unicode.IsControl) >= 0 {
+		err = errDescrip
+		return
+	}
+	if conf.DisplayName == "" {
+		conf.DisplayName = serverName
+	}
+	if conf.Description == "" {
+		conf.Description = appName + " server daemon"
+	}
+	return
+}
+
+func winServerRun(conf *Config) {
+	exepath, appName, serverName, err := serviceNames(conf)
+	if err != nil {
+		fmt.Printf("get the %s service name error %v\n", os.Args[0], err)
 		os.Exit(1)
 	}
-	appName := filepath.Base(exepath)
-	serverName := strings.Join(strings.Fields(appName), "_")
 
 	var d daemon
-	if d, err = newDaemon(exepath, appName, serverName); err != nil {
+	if d, err = newDaemon(exepath, serverName, conf); err != nil {
 		fmt.Printf("call %s daemon error %v\n", appName, err)
 		os.Exit(2)
 	}
@@ -49,94 +574,228 @@ func winServerRun() {
 //RunDaemon add daemon fun
 //change DarwinTemplate、LinuxSystemDTemplate、LinuxUpTemplater、LinuxSystemVTemplate
 func RunDaemon() {
-	cmd := ""
-	var l int
-	if l = len(os.Args); l > 1 {
-		cmd = os.Args[l-1]
-	}
-	switch cmd {
-	case "start":
-	case "restart":
-	case "stop":
-	case "status":
-	case "install":
-	case "uninstall":
-	case "-h":
-	case "Daemon":
+	RunDaemonWithConfig(Config{AutoStart: true})
+}
+
+// RunDaemonWithConfig is RunDaemon with the service settings taken from conf.
+// With conf.Command set the service verbs are only handled behind that
+// subcommand, "./app service start", and the other arguments are left alone.
+func RunDaemonWithConfig(conf Config) {
+	l := len(os.Args)
+	// Services installed by older versions are marked by a trailing "Daemon"
+	if l > 1 && os.Args[l-1] == "Daemon" {
 		os.Args = os.Args[:l-1]
+		isService = true
+	}
+	// The mark is read once, the processes the app starts are not services
+	if IsService() {
+		isService = true
+		os.Unsetenv(serviceEnv)
 		if runtime.GOOS == "windows" {
-			winServerRun()
+			winServerRun(&conf)
 		}
-		fallthrough
-	default:
 		return
 	}
 
-	os.Args = os.Args[:l-1]
-	var exepath string
-	var err error
-	if exepath, err = filepath.Abs(os.Args[0]); err != nil {
-		fmt.Printf("get the %s path error %v\n", os.Args[0], err)
-		os.Exit(1)
+	if conf.Command != "" {
+		if l < 2 || os.Args[1] != conf.Command {
+			return
+		}
+		os.Exit(ExitCode(Execute(conf, os.Args[2:])))
 	}
-	appName := filepath.Base(exepath)
-	serverName := strings.Join(strings.Fields(appName), "_")
 
-	var d daemon
-	if d, err = newDaemon(exepath, appName, serverName); err != nil {
-		fmt.Printf("call %s daemon error %v\n", appName, err)
-		os.Exit(2)
+	if l > 1 && os.Args[l-1] == "-h" {
+		fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		fs.SetOutput(os.Stdout)
+		Flags(fs, &conf)
+		fmt.Printf("=========================Daemon help=========================\n")
+		fmt.Printf("\nUsage: %s [args] <command> [flags]\n", filepath.Base(os.Args[0]))
+		printUsage(fs)
+		fmt.Printf("\n\n=========================App help=========================\n")
+		return
+	}
+	i := legacyVerb(os.Args[1:])
+	if i < 0 {
+		return
 	}
 
-	switch cmd {
-	case "start":
-		if !d.IsInstalled() {
-			args := append(os.Args[1:], "Daemon")
-			err = d.Install(args...)
+	// The arguments before the verb are the app's, the service is installed
+	// with them and the app keeps them in os.Args
+	cmd, flags := os.Args[1+i], os.Args[2+i:]
+	args := append([]string{}, os.Args[1:1+i]...)
+	if cmd == "scale" && len(flags) > 0 {
+		args, flags = append(flags[:1:1], args...), flags[1:]
+	}
+	os.Args = append(os.Args[:1], os.Args[1:1+i]...)
+	os.Exit(ExitCode(Execute(conf, append(append([]string{cmd}, flags...), append([]string{"--"}, args...)...))))
+}
+
+// legacyVerb returns the index in args of the verb of the RunDaemon form, the
+// first verb followed by nothing but its flags, or -1 when there is none.
+// The flags of the app before it are never taken for the service's.
+func legacyVerb(args []string) int {
+	for i, arg := range args {
+		if !isVerb(arg) {
+			continue
+		}
+		rest := args[i+1:]
+		if arg == "scale" && len(rest) > 0 {
+			if _, err := strconv.Atoi(rest[0]); err == nil {
+				rest = rest[1:]
+			}
 		}
-		if err == nil {
-			err = d.Start()
+		var conf Config
+		fs := flag.NewFlagSet(arg, flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		Flags(fs, &conf)
+		verbFlags(fs, arg, new(string), new(Package))
+		if fs.Parse(rest) == nil && fs.NArg() == 0 {
+			return i
 		}
-	case "restart":
-		err = d.Restart()
-	case "stop":
-		err = d.Stop()
-	case "status":
-		if !d.IsInstalled() {
-			fmt.Printf("%s is not install\n", serverName)
+	}
+	return -1
+}
+
+// report prints err on stderr unless conf is quiet and returns it
+func report(conf *Config, err error) error {
+	if err != nil && !conf.Quiet && conf.Output != "json" && !errors.Is(err, errRunning) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return err
+}
+
+// validateName checks the parts of a service name every init system rejects,
+// the backends escape the rest
+func validateName(name string) error {
+	if name == "" || name == "." || name == ".." || len(name) > 200 || strings.ContainsRune(name, '/') {
+		return errName
+	}
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return errName
+		}
+	}
+	return nil
+}
+
+// escapeName replaces the characters keep rejects by '_'
+func escapeName(name string, keep func(r rune) bool) string {
+	return strings.Map(func(r rune) rune {
+		if keep(r) {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// isNameChar reports whether r is in [A-Za-z0-9_.@-], the characters that
+// are safe in file names, shell scripts and most init systems
+func isNameChar(r rune) bool {
+	return r < utf8.RuneSelf && (r == '_' || r == '.' || r == '@' || r == '-' ||
+		'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+}
+
+// waitState polls d until it is running, or stopped, long enough to trust it
+// or until conf.Timeout passes
+func waitState(d daemon, conf *Config, name string, running bool) error {
+	timeout := conf.Timeout
+	if timeout < 0 {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	settle := settleTime
+	if settle > timeout/2 {
+		settle = timeout / 2
+	}
+
+	deadline := time.Now().Add(timeout)
+	var since time.Time
+	for {
+		st, err := d.Status()
+		if err != nil {
+			return err
+		}
+		if st.Running != running {
+			since = time.Time{}
+		} else if since.IsZero() {
+			since = time.Now()
+		}
+		if !since.IsZero() && (!running || time.Since(since) >= settle) {
+			return nil
+		}
+		if time.Now().After(deadline) {
 			break
 		}
-		if err = d.Status(); err != nil {
-			fmt.Printf("%s is dead\n", serverName)
-		} else {
-			fmt.Printf("%s is running\n", serverName)
-		}
-		err = nil
-	case "install":
-		args := append(os.Args[1:], "Daemon")
-		err = d.Install(args...)
-	case "uninstall":
-		err = d.UnInstall()
-	case "-h":
-		os.Args = append(os.Args, "-h")
-		fmt.Printf("=========================Daemon help=========================\n")
-		fmt.Printf("\nUsage: %s start|restart|stop|status|install|uninstall|-h\n", appName)
-		fmt.Printf("%s args start \tto start %s service\n", appName, serverName)
-		fmt.Printf("%s restart \t\tto restart %s service\n", appName, serverName)
-		fmt.Printf("%s stop \t\tto stop %s service\n", appName, serverName)
-		fmt.Printf("%s status \t\tto show %s service status\n", appName, serverName)
-		fmt.Printf("sudo %s args install \tto install %s service\n", appName, serverName)
-		fmt.Printf("sudo %s uninstall \tto uninstall %s service\n", appName, serverName)
-		fmt.Printf("-h \t\t\t show this page\n")
-		fmt.Printf("\n\n=========================App help=========================\n")
-		return
+		time.Sleep(pollInterval)
+	}
+
+	serr := &StateError{Name: name, Running: running}
+	if dg, ok := d.(diagnoser); ok {
+		lines := conf.LogLines
+		if lines == 0 {
+			lines = defaultLogLines
+		}
+		serr.ExitStatus, serr.Logs = dg.diagnose(lines)
+	}
+	return serr
+}
+
+// readPID returns the process id in the pid file at path, or 0
+func readPID(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// matchFile returns the first group of re in the service definition at
+// path, empty when it does not match
+func matchFile(path string, re *regexp.Regexp) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	m := re.FindSubmatch(data)
+	if m == nil {
+		return ""
 	}
+	return string(m[1])
+}
+
+// tailFile returns the last n lines of the file at path
+func tailFile(path string, n int) []string {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Printf("to %s %s err:%v\n", cmd, serverName, err)
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
 	}
-	os.Exit(0)
+	return lines
 }
 
+// Instance returns the instance name of the running service, or "" when it
+// was not started as one of several named instances
+func Instance() string {
+	return os.Getenv(instanceEnv)
+}
+
+// IsService reports whether the process was started by the init system from
+// a service installed by this package, apps can use it to pick for example
+// their log format
+func IsService() bool {
+	return isService || os.Getenv(serviceEnv) != ""
+}
+
+// isService keeps the mark of a service once RunDaemon took it from the
+// environment
+var isService bool
+
 func checkRootGroup() bool {
 	stdout, err := exec.Command("id", "-g").Output()
 	if err != nil {
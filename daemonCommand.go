@@ -0,0 +1,520 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// verbs are the commands RunDaemon and Execute handle
+var verbs = []struct {
+	name, args, usage string
+}{
+	{"start", "[args]", "install the service if needed and start it"},
+	{"restart", "", "restart the service"},
+	{"stop", "", "stop the service"},
+	{"status", "", "show the service status"},
+	{"install", "[args]", "install the service to run with args"},
+	{"uninstall", "", "uninstall the service"},
+	{"enable", "", "start the service at boot"},
+	{"disable", "", "do not start the service at boot"},
+	{"scale", "N [args]", "run instances 1..N of the service"},
+	{"apply", "-f FILE", "converge the service to the state a manifest declares"},
+	{"list", "", "list the services installed by this package"},
+	{"package", "--format F", "build a deb or rpm package of the service"},
+}
+
+// Command is a service verb, ready to be added to a command tree like cobra:
+//
+//	for _, c := range daemon.Commands(conf) {
+//		c := c
+//		service.AddCommand(&cobra.Command{
+//			Use:                c.Name + " " + c.Args,
+//			Short:              c.Short,
+//			DisableFlagParsing: true,
+//			RunE:               func(_ *cobra.Command, args []string) error { return c.Run(args) },
+//		})
+//	}
+type Command struct {
+	Name  string
+	Args  string
+	Short string
+	// Run parses the verb flags from args and runs the verb
+	Run func(args []string) error
+}
+
+// Commands returns the service verbs as commands using conf
+func Commands(conf Config) []Command {
+	cmds := make([]Command, 0, len(verbs))
+	for _, v := range verbs {
+		name := v.name
+		cmds = append(cmds, Command{v.name, v.args, v.usage, func(args []string) error {
+			return Execute(conf, append([]string{name}, args...))
+		}})
+	}
+	return cmds
+}
+
+// Flags registers the flags every service verb accepts on fs, so an app
+// using the flag package can offer them with its own flags
+func Flags(fs *flag.FlagSet, conf *Config) {
+	fs.StringVar(&conf.Instance, "instance", conf.Instance, "run the command on one named instance of the service")
+	fs.StringVar(&conf.Name, "name", conf.Name, "service name, by default the binary name")
+	fs.StringVar(&conf.DisplayName, "display-name", conf.DisplayName, "name the service manager shows")
+	fs.StringVar(&conf.Description, "description", conf.Description, "service description")
+	fs.DurationVar(&conf.Timeout, "timeout", conf.Timeout, "how long to wait for the service to start or stop, 10s by default")
+	fs.DurationVar(&conf.LockTimeout, "lock-timeout", conf.LockTimeout, "how long to wait while another command changes the service, 30s by default")
+	fs.IntVar(&conf.LogLines, "log-lines", conf.LogLines, "number of log lines shown when the service fails, 10 by default")
+	fs.BoolVar(&conf.Quiet, "quiet", conf.Quiet, "print nothing, the exit code tells the result")
+	fs.StringVar(&conf.Output, "output", conf.Output, "output format, text or json")
+	fs.BoolVar(&conf.Force, "force", conf.Force, "replace or remove service files this package did not write")
+	fs.BoolVar(&conf.Purge, "purge", conf.Purge, "uninstall deletes the service logs and state too")
+	fs.BoolVar(&conf.All, "all", conf.All, "run start, stop, restart, status, enable or disable on every service list shows")
+	fs.StringVar(&conf.Root, "root", conf.Root, "install into the filesystem under this directory, like an image being built")
+	fs.StringVar(&conf.Runit.Dir, "runit-dir", conf.Runit.Dir, "directory holding the runit service directories, /etc/sv by default")
+	fs.StringVar(&conf.Runit.ServiceDir, "runit-service-dir", conf.Runit.ServiceDir, "directory runsvdir supervises, selects runit when set")
+	fs.StringVar(&conf.S6.Dir, "s6-dir", conf.S6.Dir, "directory holding the s6 service directories, /etc/s6/sv by default")
+	fs.StringVar(&conf.S6.ScanDir, "s6-scan-dir", conf.S6.ScanDir, "scan directory s6-svscan watches, selects s6 when set")
+	fs.StringVar(&conf.Supervisor.ConfDir, "supervisor-conf-dir", conf.Supervisor.ConfDir, "directory supervisord includes programs from, selects supervisord when set")
+}
+
+// Execute runs the service verb args[0] with the flags that follow it, the
+// remaining arguments, or the ones after "--", are the arguments the service
+// is installed with. Errors are reported on stderr unless --quiet is given.
+// An app using the flag package can hand its subcommand over with
+// os.Exit(daemon.ExitCode(daemon.Execute(conf, flag.Args()[1:]))).
+func Execute(conf Config, args []string) error {
+	fs := flag.NewFlagSet(conf.Command, flag.ContinueOnError)
+	Flags(fs, &conf)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s <command> [flags] [-- args]\n", os.Args[0], conf.Command)
+		printUsage(fs)
+	}
+
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if !isVerb(args[0]) {
+		err := fmt.Errorf("unknown command %q", args[0])
+		fmt.Fprintln(fs.Output(), err)
+		fs.Usage()
+		return &codeError{ExitUsage, err}
+	}
+
+	fs.Init(conf.Command+" "+args[0], flag.ContinueOnError)
+	var file string
+	var p Package
+	verbFlags(fs, args[0], &file, &p)
+	if err := fs.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		return &codeError{ExitUsage, err}
+	}
+	rest := fs.Args()
+	switch args[0] {
+	case "apply":
+		rest = append([]string{file}, rest...)
+	case "package":
+		rest = append(p.Args(), rest...)
+	}
+	return RunCommand(conf, args[0], rest)
+}
+
+// verbFlags registers on fs the flags only the verb cmd accepts, the manifest
+// file of apply and the package settings
+func verbFlags(fs *flag.FlagSet, cmd string, file *string, p *Package) {
+	switch cmd {
+	case "apply":
+		fs.StringVar(file, "f", "", "manifest file, YAML or JSON")
+	case "package":
+		PackageFlags(fs, p)
+	}
+}
+
+// RunCommand runs the service verb cmd with conf as it is, for callers that
+// parse the flags themselves. args are the arguments the service is installed
+// with, for scale they follow the instance count, for apply the manifest
+// file comes first and for package the package flags, ended by "--".
+// Errors are reported on stderr unless conf is quiet.
+func RunCommand(conf Config, cmd string, args []string) error {
+	if !isVerb(cmd) {
+		return report(&conf, &codeError{ExitUsage, fmt.Errorf("unknown command %q", cmd)})
+	}
+	return report(&conf, run(&conf, cmd, args))
+}
+
+func isVerb(cmd string) bool {
+	for _, v := range verbs {
+		if v.name == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func printUsage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "\nCommands:\n")
+	for _, v := range verbs {
+		fmt.Fprintf(w, "  %-20s%s\n", strings.TrimSpace(v.name+" "+v.args), v.usage)
+	}
+	fmt.Fprintf(w, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// run executes the service verb cmd, args are the arguments the service is
+// installed with, for scale they follow the instance count. The returned
+// error maps to the verb's exit code with ExitCode.
+func run(conf *Config, cmd string, args []string) error {
+	if conf.Output != "" && conf.Output != "text" && conf.Output != "json" {
+		return &codeError{ExitUsage, fmt.Errorf("unknown output format %q", conf.Output)}
+	}
+	switch {
+	case cmd == "apply":
+		return runApply(conf, args)
+	case cmd == "list":
+		return runList(conf)
+	case cmd == "package":
+		return runPackage(conf, args)
+	case conf.All:
+		return runAll(conf, cmd)
+	}
+	if conf.offline() && (cmd == "start" || cmd == "stop" || cmd == "restart" || cmd == "scale") {
+		return errOffline
+	}
+	exepath, _, serverName, err := serviceNames(conf)
+	if err != nil {
+		return &codeError{ExitUsage, err}
+	}
+
+	d, err := newDaemon(exepath, serverName, conf)
+	if err != nil {
+		return err
+	}
+	label := serverName
+	if conf.Instance != "" {
+		label += "@" + conf.Instance
+	}
+
+	// scale takes the lock of every instance it changes
+	if cmd != "status" && cmd != "scale" {
+		unlock, err := lockDaemon(conf, d)
+		if err != nil {
+			return fmt.Errorf("to %s %s err:%w", cmd, label, err)
+		}
+		defer unlock()
+	}
+
+	if cmd == "scale" {
+		var n int
+		if len(args) > 0 {
+			n, err = strconv.Atoi(args[0])
+		}
+		if len(args) == 0 || err != nil || n < 0 {
+			return &codeError{ExitUsage, fmt.Errorf("scale needs the number of instances")}
+		}
+		err = scale(exepath, serverName, *conf, n, args[1:])
+		if conf.Output == "json" {
+			return printScale(exepath, serverName, *conf, n, err)
+		}
+	} else {
+		err = do(d, conf, cmd, label, args)
+	}
+	if err != nil {
+		err = fmt.Errorf("to %s %s err:%w", cmd, label, err)
+	}
+	if conf.Output == "json" {
+		printJSON(result(cmd, d, err))
+	}
+	return err
+}
+
+// do runs the verb cmd on the service d named label
+func do(d daemon, conf *Config, cmd, label string, args []string) (err error) {
+	switch cmd {
+	case "start":
+		if !d.IsInstalled() {
+			err = d.Install(args...)
+		}
+		if err == nil {
+			err = start(d, conf, label)
+		}
+	case "restart":
+		if err = d.Restart(); err == nil {
+			err = waitState(d, conf, label, true)
+		}
+	case "stop":
+		err = stop(d, conf, label)
+	case "status":
+		var st *Status
+		if st, err = d.Status(); err != nil {
+			return &codeError{ExitUnknown, err}
+		}
+		boot := "disabled"
+		if st.Enabled {
+			boot = "enabled"
+		}
+		state := "running"
+		if !st.Running {
+			state = "dead"
+			err = &codeError{ExitNotRunning, errRunning}
+		}
+		if !conf.Quiet && conf.Output != "json" {
+			fmt.Printf("%s is %s, start at boot %s\n", label, state, boot)
+		}
+	case "install":
+		err = d.Install(args...)
+	case "uninstall":
+		err = d.UnInstall()
+	case "enable":
+		err = d.Enable()
+	case "disable":
+		err = d.Disable()
+	}
+	return err
+}
+
+// doLocked runs do holding the lock of the service, status needs none
+func doLocked(d daemon, conf *Config, cmd, label string) error {
+	if cmd != "status" {
+		unlock, err := lockDaemon(conf, d)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return do(d, conf, cmd, label, nil)
+}
+
+// runList prints the services List finds
+func runList(conf *Config) error {
+	sts, err := listStatus(conf)
+	if err != nil {
+		return fmt.Errorf("to list services err:%w", err)
+	}
+	switch {
+	case conf.Output == "json":
+		printJSON(sts)
+	case !conf.Quiet:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tBACKEND\tSTATE\tENABLED\tVERSION\tINSTALLED")
+		for _, st := range sts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\n", st.Name, st.Backend, st.State, st.Enabled, st.Version, st.Installed)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+// runAll runs cmd on every service List finds. All of them are tried, the
+// error reports every failure.
+func runAll(conf *Config, cmd string) error {
+	switch cmd {
+	case "start", "stop", "restart", "status", "enable", "disable":
+	default:
+		return &codeError{ExitUsage, fmt.Errorf("--all does not work with %s", cmd)}
+	}
+	ds, err := listDaemons(conf)
+	if err != nil {
+		return fmt.Errorf("to list services err:%w", err)
+	}
+
+	// A stopped service only sets the exit code of status, the failures are
+	// reported apart from it
+	var stopped error
+	var failed []error
+	outs := make([]*output, 0, len(ds))
+	for _, d := range ds {
+		label := d.describe().Name
+		err := doLocked(d, conf, cmd, label)
+		if err != nil {
+			err = fmt.Errorf("to %s %s err:%w", cmd, label, err)
+			if !errors.Is(err, errRunning) {
+				failed = append(failed, err)
+			} else if stopped == nil {
+				stopped = err
+			}
+		}
+		outs = append(outs, result(cmd, d, err))
+	}
+	if conf.Output == "json" {
+		printJSON(outs)
+	}
+	if len(failed) == 0 {
+		return stopped
+	}
+
+	// The exit code is the one of the first failure
+	err = failed[0]
+	for _, ferr := range failed[1:] {
+		err = fmt.Errorf("%w\n%s", err, ferr)
+	}
+	return err
+}
+
+// runApply converges the service to the manifest args[0] and prints the
+// actions it took
+func runApply(conf *Config, args []string) error {
+	if len(args) == 0 || args[0] == "" {
+		return &codeError{ExitUsage, fmt.Errorf("apply needs a manifest, -f FILE")}
+	}
+	m, err := ReadManifest(args[0])
+	if err != nil {
+		return &codeError{ExitUsage, err}
+	}
+
+	actions, err := apply(conf, m)
+	exepath, _, serverName, nerr := serviceNames(conf)
+	if nerr != nil {
+		return &codeError{ExitUsage, nerr}
+	}
+	label := serverName
+	if conf.Instance != "" {
+		label += "@" + conf.Instance
+	}
+	if err != nil {
+		err = fmt.Errorf("to apply %s err:%w", label, err)
+	}
+
+	switch {
+	case conf.Output == "json":
+		d, derr := newDaemon(exepath, serverName, conf)
+		if derr != nil {
+			return derr
+		}
+		out := result("apply", d, err)
+		out.Actions = actions
+		printJSON(out)
+	case conf.Quiet:
+	case len(actions) == 0 && err == nil:
+		fmt.Printf("%s: no changes\n", label)
+	case len(actions) > 0:
+		fmt.Printf("%s: %s\n", label, strings.Join(actions, ", "))
+	}
+	return err
+}
+
+// output is what --output=json prints for a verb
+type output struct {
+	Command string `json:"command"`
+	*Status
+	// Actions are the steps apply took
+	Actions []string `json:"actions,omitempty"`
+	// File is the package the package verb wrote
+	File     string       `json:"file,omitempty"`
+	ExitCode int          `json:"exit_code"`
+	Error    *outputError `json:"error,omitempty"`
+}
+
+type outputError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// result describes d after the verb cmd ended with err
+func result(cmd string, d daemon, err error) *output {
+	out := &output{Command: cmd, ExitCode: ExitCode(err)}
+	if d.IsInstalled() {
+		out.Status, _ = d.Status()
+	}
+	if out.Status == nil {
+		out.Status = d.describe()
+		out.State = "not-installed"
+	}
+	if err != nil && !errors.Is(err, errRunning) {
+		out.Error = &outputError{err.Error(), out.ExitCode}
+	}
+	return out
+}
+
+// printScale prints the result of every instance scale started
+func printScale(exepath, serverName string, conf Config, n int, err error) error {
+	if err != nil {
+		err = fmt.Errorf("to scale %s err:%w", serverName, err)
+	}
+	outs := make([]*output, 0, n)
+	for i := 1; i <= n; i++ {
+		conf.Instance = strconv.Itoa(i)
+		d, derr := newDaemon(exepath, serverName, &conf)
+		if derr != nil {
+			return derr
+		}
+		outs = append(outs, result("scale", d, err))
+	}
+	printJSON(outs)
+	return err
+}
+
+func printJSON(v interface{}) {
+	data, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Printf("%s\n", data)
+}
+
+// scale installs and starts instances 1..n, the numbered instances above n
+// are stopped and no longer started at boot
+func scale(exepath, serverName string, conf Config, n int, args []string) error {
+	for i := 1; ; i++ {
+		conf.Instance = strconv.Itoa(i)
+		d, err := newDaemon(exepath, serverName, &conf)
+		if err != nil {
+			return err
+		}
+
+		name := serverName + "@" + conf.Instance
+		if i > n && !d.IsInstalled() {
+			return nil
+		}
+		if err = scaleInstance(d, &conf, name, i <= n, args); err != nil {
+			return err
+		}
+	}
+}
+
+// scaleInstance starts or stops one instance for scale, holding its lock
+func scaleInstance(d daemon, conf *Config, name string, up bool, args []string) error {
+	unlock, err := lockDaemon(conf, d)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !up {
+		if err = stop(d, conf, name); err != nil {
+			return err
+		}
+		return d.Disable()
+	}
+
+	if !d.IsInstalled() {
+		err = d.Install(args...)
+	} else if conf.AutoStart {
+		err = d.Enable()
+	}
+	if err != nil {
+		return err
+	}
+	return start(d, conf, name)
+}
+
+// start starts d and waits until it runs
+func start(d daemon, conf *Config, name string) error {
+	if err := d.Start(); err != nil {
+		return err
+	}
+	return waitState(d, conf, name, true)
+}
+
+// stop stops d and waits until it is stopped
+func stop(d daemon, conf *Config, name string) error {
+	if err := d.Stop(); err != nil {
+		return err
+	}
+	return waitState(d, conf, name, false)
+}
@@ -0,0 +1,36 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLegacyVerb(t *testing.T) {
+	tests := []struct {
+		args string
+		want int
+	}{
+		{"", -1},
+		{"serve", -1},
+		{"start", 0},
+		{"backup start", 1},
+		// The flags of the app are its own, whatever their names
+		{"--name x --timeout 5s --quiet --output out start", 7},
+		{"--name install start", 2},
+		{"--port 8080 install --instance a --timeout=5s --quiet", 2},
+		{"install --name start", 0},
+		{"start stop", 1},
+		{"start --port 8080", -1},
+		{"start extra", -1},
+		{"scale 4", 0},
+		{"--port 1 scale 4 --timeout 1s", 2},
+		{"apply -f app.yaml", 0},
+		{"package --format=deb --version 1.0", 0},
+		{"start --format=deb", -1},
+	}
+	for _, tt := range tests {
+		if got := legacyVerb(strings.Fields(tt.args)); got != tt.want {
+			t.Errorf("legacyVerb(%q) = %d, want %d", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeFile replaces path with data atomically: the data is written and
+// synced to a temporary file in the same directory, which is renamed over
+// path. A crash leaves either the old or the new file, never a truncated one.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Make the rename itself durable, not every system can sync a directory
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// removeFiles removes the files and directories at paths, skipping the ones
+// that are gone already
+func removeFiles(paths ...string) error {
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journal records the steps of an install so a failed install can undo
+// them in reverse order, leaving the host as it was
+type journal struct {
+	conf *Config
+	undo []func() error
+}
+
+// add records how to undo a step that was done
+func (j *journal) add(undo func() error) {
+	j.undo = append(j.undo, undo)
+}
+
+// writeFile writes path with writeFile, undone by restoring the file that
+// was there before or removing the new one
+func (j *journal) writeFile(path string, data []byte, perm os.FileMode) error {
+	old, err := ioutil.ReadFile(path)
+	existed := err == nil
+	var oldPerm os.FileMode
+	if info, err := os.Stat(path); err == nil {
+		oldPerm = info.Mode().Perm()
+	}
+
+	if err := writeFile(path, data, perm); err != nil {
+		return err
+	}
+	j.add(func() error {
+		if existed {
+			return writeFile(path, old, oldPerm)
+		}
+		return os.Remove(path)
+	})
+	return nil
+}
+
+// remove removes the file at path if there is one, undone by writing it back
+func (j *journal) remove(path string) error {
+	old, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	info, serr := os.Stat(path)
+	if err == nil {
+		err = serr
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return err
+	}
+	j.add(func() error {
+		return writeFile(path, old, info.Mode().Perm())
+	})
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents, undone by removing the
+// directories it created
+func (j *journal) mkdirAll(dir string, perm os.FileMode) error {
+	var created []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil || d == filepath.Dir(d) {
+			break
+		}
+		created = append(created, d)
+	}
+
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	j.add(func() error {
+		for _, d := range created {
+			if err := os.Remove(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// symlink makes path a link to target, undone by removing it or restoring the
+// link that was there before
+func (j *journal) symlink(target, path string) error {
+	old, err := os.Readlink(path)
+	existed := err == nil
+	if existed {
+		if old == target {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+	j.add(func() error {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if existed {
+			return os.Symlink(old, path)
+		}
+		return nil
+	})
+	return nil
+}
+
+// run runs the command cmd, undone by running the command undo when it is
+// not empty
+func (j *journal) run(cmd []string, undo []string) error {
+	if err := j.conf.command(cmd[0], cmd[1:]...); err != nil {
+		return fmt.Errorf("%s: %w", strings.Join(cmd, " "), err)
+	}
+	if len(undo) > 0 {
+		j.add(func() error {
+			return j.conf.command(undo[0], undo[1:]...)
+		})
+	}
+	return nil
+}
+
+// rollback undoes the recorded steps in reverse order after err ended the
+// install. The returned error is err, with the steps that failed to undo.
+func (j *journal) rollback(err error) error {
+	var failed []string
+	for i := len(j.undo) - 1; i >= 0; i-- {
+		if uerr := j.undo[i](); uerr != nil {
+			failed = append(failed, uerr.Error())
+		}
+	}
+	j.undo = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("%w, rollback failed: %s", err, strings.Join(failed, "; "))
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version of the package, recorded in the files it installs
+const Version = "1.0.0"
+
+const owner = "github.com/miaia/daemon"
+
+// markerRe matches the ownership marker withMarker adds to a service file
+var markerRe = regexp.MustCompile(`managed-by: ` + regexp.QuoteMeta(owner) + ` (\S+) installed (\S+)`)
+
+// marker is the ownership marker text, naming the package version and the
+// install time
+func marker() string {
+	return "managed-by: " + owner + " " + Version + " installed " + time.Now().UTC().Format(time.RFC3339)
+}
+
+// withMarker adds the ownership marker to a rendered service file as a
+// comment, after the #! or <?xml line when there is one
+func withMarker(data []byte) []byte {
+	line := "# " + marker() + "\n"
+	if bytes.HasPrefix(data, []byte("<?xml")) {
+		line = "<!-- " + marker() + " -->\n"
+	}
+
+	var head []byte
+	if bytes.HasPrefix(data, []byte("#!")) || bytes.HasPrefix(data, []byte("<?xml")) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			head, data = data[:i+1], data[i+1:]
+		}
+	}
+	return append(append(append([]byte{}, head...), line...), data...)
+}
+
+// readMarker returns the package version and install time recorded in the
+// service file at path, ok is false for files this package did not write
+func readMarker(path string) (version, installed string, ok bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+
+	// The marker is on the first or the second line
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < 2 && scanner.Scan(); i++ {
+		if m := markerRe.FindStringSubmatch(scanner.Text()); m != nil {
+			return m[1], m[2], true
+		}
+	}
+	return "", "", false
+}
+
+// isOwned reports whether this package wrote the service file at path
+func isOwned(path string) bool {
+	_, _, ok := readMarker(path)
+	return ok
+}
+
+// checkOwner fails for a file at path this package did not write, unless
+// conf.Force is set. Nothing is overwritten or removed without this check.
+func checkOwner(conf *Config, path string) error {
+	if _, err := os.Stat(path); err != nil || conf.Force || isOwned(path) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", path, errNotOwned)
+}
+
+// keepInstalled tells Install whether the service file at path is in place
+// already. A file this package did not write is an error, or is replaced
+// with conf.Force, a file it wrote is replaced on a reinstall.
+func keepInstalled(conf *Config, path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, nil
+	}
+	if isOwned(path) {
+		return !conf.reinstall, nil
+	}
+	return false, checkOwner(conf, path)
+}
+
+// isRendered reports whether the file at path holds want, its ownership
+// marker aside
+func isRendered(path string, want []byte) bool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var lines [][]byte
+	for _, l := range bytes.SplitAfter(data, []byte("\n")) {
+		if !markerRe.Match(l) {
+			lines = append(lines, l)
+		}
+	}
+	return bytes.Equal(bytes.Join(lines, nil), want)
+}
+
+// ownedFiles returns the files in dir named prefix<name>suffix that carry the
+// ownership marker, by name
+func ownedFiles(dir, prefix, suffix string) map[string]string {
+	files := map[string]string{}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return files
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if _, _, ok := readMarker(dir + "/" + name); ok {
+			files[strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)] = dir + "/" + name
+		}
+	}
+	return files
+}
+
+// List returns the status of every service this package installed, found by
+// the ownership marker of their service files
+func List() ([]*Status, error) {
+	return listStatus(&Config{})
+}
+
+func listStatus(conf *Config) ([]*Status, error) {
+	ds, err := listDaemons(conf)
+	if err != nil {
+		return nil, err
+	}
+	sts := make([]*Status, 0, len(ds))
+	for _, d := range ds {
+		st, err := d.Status()
+		if err != nil {
+			return nil, err
+		}
+		if st.Version == "" {
+			st.Version, st.Installed, _ = readMarker(st.Path)
+		}
+		sts = append(sts, st)
+	}
+	sort.Slice(sts, func(i, j int) bool { return sts[i].Name < sts[j].Name })
+	return sts, nil
+}
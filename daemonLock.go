@@ -0,0 +1,85 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultLockTimeout is how long a command waits for another one holding
+// the lock of the service
+const defaultLockTimeout = 30 * time.Second
+
+var errLocked = errors.New("Service is locked by another process")
+
+// lockDaemon takes the lock of d with lockService. The lock is named after
+// the service as the init system knows it, escaped and with its instance, so
+// every command reaching the same service takes the same lock.
+func lockDaemon(conf *Config, d daemon) (func(), error) {
+	return lockService(conf, d.describe().Name)
+}
+
+// lockService takes the exclusive lock of the service name, so commands run
+// at the same time on the host do not interleave their changes. It waits up
+// to conf.LockTimeout for the process holding it and returns the function
+// that releases it. An offline command takes no lock, so no lock file ends
+// up in the image being built under Root.
+func lockService(conf *Config, name string) (func(), error) {
+	if conf.offline() {
+		return func() {}, nil
+	}
+
+	dir := conf.path(lockDir())
+	path := filepath.Join(dir, escapeName(name, isNameChar)+".lock")
+	err := os.MkdirAll(dir, 0755)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	}
+	if os.IsPermission(err) {
+		return nil, errPermit
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := conf.LockTimeout
+	if timeout == 0 {
+		timeout = defaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if timeout < 0 || time.Now().After(deadline) {
+			f.Close()
+			msg := path
+			if holder, _ := ioutil.ReadFile(path); len(holder) > 0 {
+				msg = strings.TrimSpace(string(holder)) + " holds " + path
+			}
+			if timeout > 0 {
+				msg += ", waited " + timeout.String()
+			}
+			return nil, fmt.Errorf("%w, %s", errLocked, msg)
+		}
+		time.Sleep(pollInterval)
+	}
+
+	// Tell the processes that wait who holds the lock
+	f.Truncate(0)
+	f.WriteAt([]byte(fmt.Sprintf("pid %d since %s\n", os.Getpid(), time.Now().Format(time.RFC3339))), 0)
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
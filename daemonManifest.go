@@ -0,0 +1,440 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Manifest declares the desired state of a service for Apply. It is read
+// from YAML or JSON:
+//
+//	name: billing
+//	args: [--port, "8080"]
+//	env:
+//	  LOG_LEVEL: info
+//	user: billing
+//	limits:
+//	  nofile: 65536
+//	hardening:
+//	  no_new_privileges: true
+//	  protect_system: strict
+//	enabled: true
+//	running: true
+type Manifest struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Exec        string            `json:"exec"`
+	Args        []string          `json:"args"`
+	Env         map[string]string `json:"env"`
+	User        string            `json:"user"`
+	Group       string            `json:"group"`
+	Limits      Limits            `json:"limits"`
+	Hardening   Hardening         `json:"hardening"`
+	// Enabled and Running are left as they are when nil
+	Enabled *bool `json:"enabled"`
+	Running *bool `json:"running"`
+}
+
+// ReadManifest reads a YAML or JSON manifest from path
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		if err = json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return m, nil
+	}
+
+	v, err := parseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err = decodeValue(v, reflect.ValueOf(m).Elem()); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Apply converges the service to the state m declares, installing it or
+// rewriting its files in place and restarting it, enabling or disabling it
+// and starting or stopping it as needed. It returns the actions it took,
+// none when the host already matches.
+func Apply(m *Manifest) ([]string, error) {
+	return apply(&Config{}, m)
+}
+
+// apply converges the service m declares, conf is updated with the
+// settings taken from m
+func apply(conf *Config, m *Manifest) ([]string, error) {
+	if m.Name != "" {
+		conf.Name = m.Name
+	}
+	if m.Description != "" {
+		conf.Description = m.Description
+	}
+	if m.Exec != "" {
+		conf.Exec = m.Exec
+	}
+	conf.User, conf.Group = m.User, m.Group
+	conf.Env, conf.Limits, conf.Hardening = m.Env, m.Limits, m.Hardening
+	conf.AutoStart = m.Enabled == nil || *m.Enabled
+
+	exepath, _, serverName, err := serviceNames(conf)
+	if err != nil {
+		return nil, &codeError{ExitUsage, err}
+	}
+	d, err := newDaemon(exepath, serverName, conf)
+	if err != nil {
+		return nil, err
+	}
+	name := serverName
+	if conf.Instance != "" {
+		name += "@" + conf.Instance
+	}
+	unlock, err := lockDaemon(conf, d)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var actions []string
+	wasRunning, reconfigured := false, false
+	if !d.IsInstalled() {
+		if err = d.Install(m.Args...); err != nil {
+			return actions, err
+		}
+		actions = append(actions, "install")
+	} else {
+		st, err := d.Status()
+		if err != nil {
+			return actions, err
+		}
+		wasRunning = st.Running
+		if m.Enabled == nil {
+			conf.AutoStart = st.Enabled
+		}
+
+		// The files are replaced in place, an install that fails restores
+		// them and the service keeps running as it was
+		if !d.isCurrent(m.Args...) {
+			conf.reinstall = true
+			err = d.Install(m.Args...)
+			conf.reinstall = false
+			if err != nil {
+				return actions, err
+			}
+			actions = append(actions, "reconfigure")
+			reconfigured = true
+		}
+	}
+
+	st, err := d.Status()
+	if err != nil {
+		return actions, err
+	}
+	if m.Enabled != nil && st.Enabled != *m.Enabled {
+		if *m.Enabled {
+			err = d.Enable()
+			actions = append(actions, "enable")
+		} else {
+			err = d.Disable()
+			actions = append(actions, "disable")
+		}
+		if err != nil {
+			return actions, err
+		}
+	}
+
+	running := wasRunning
+	if m.Running != nil {
+		running = *m.Running
+	}
+	switch {
+	case reconfigured && st.Running && running:
+		// The service runs with the old files until it is restarted
+		if err = d.Restart(); err == nil {
+			err = waitState(d, conf, name, true)
+		}
+		actions = append(actions, "restart")
+	case (m.Running != nil || wasRunning) && st.Running != running:
+		if running {
+			err = start(d, conf, name)
+			actions = append(actions, "start")
+		} else {
+			err = stop(d, conf, name)
+			actions = append(actions, "stop")
+		}
+	}
+	return actions, err
+}
+
+type yamlLine struct {
+	num, indent int
+	text        string
+}
+
+// parseYAML parses the block style YAML manifests are written in: nested
+// mappings, sequences, flow sequences like [a, b], quoted scalars and
+// comments. Scalars are returned as strings, decodeValue converts them.
+func parseYAML(data []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimRight(stripComment(l), " \t\r")
+		if strings.TrimSpace(l) == "" || l == "---" {
+			continue
+		}
+		text := strings.TrimLeft(l, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{i + 1, len(l) - len(text), text})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	v, next, err := parseBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next < len(lines) {
+		return nil, fmt.Errorf("line %d: bad indentation", lines[next].num)
+	}
+	return v, nil
+}
+
+// stripComment removes a '#' comment that is not inside quotes
+func stripComment(l string) string {
+	var quote byte
+	for i := 0; i < len(l); i++ {
+		switch c := l[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || l[i-1] == ' ' || l[i-1] == '\t'):
+			return l[:i]
+		}
+	}
+	return l
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseBlock parses the mapping or sequence starting at lines[i] with the
+// given indent and returns it with the index of the first line after it
+func parseBlock(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	if isSeqItem(lines[i].text) {
+		var seq []interface{}
+		for i < len(lines) && lines[i].indent == indent && isSeqItem(lines[i].text) {
+			item := strings.TrimSpace(strings.TrimPrefix(lines[i].text, "-"))
+			i++
+			if item != "" {
+				v, err := parseScalar(item)
+				if err != nil {
+					return nil, i, fmt.Errorf("line %d: %v", lines[i-1].num, err)
+				}
+				seq = append(seq, v)
+				continue
+			}
+			if i >= len(lines) || lines[i].indent <= indent {
+				seq = append(seq, "")
+				continue
+			}
+			v, next, err := parseBlock(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, next, err
+			}
+			seq, i = append(seq, v), next
+		}
+		return seq, i, nil
+	}
+
+	m := map[string]interface{}{}
+	for i < len(lines) && lines[i].indent == indent {
+		l := lines[i]
+		if isSeqItem(l.text) {
+			return nil, i, fmt.Errorf("line %d: sequence item in a mapping", l.num)
+		}
+		key, value := l.text, ""
+		if j := strings.Index(l.text, ": "); j >= 0 {
+			key, value = l.text[:j], strings.TrimSpace(l.text[j+2:])
+		} else if strings.HasSuffix(l.text, ":") {
+			key = strings.TrimSuffix(l.text, ":")
+		} else {
+			return nil, i, fmt.Errorf("line %d: expected key: value", l.num)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		i++
+
+		switch {
+		case value != "":
+			v, err := parseScalar(value)
+			if err != nil {
+				return nil, i, fmt.Errorf("line %d: %v", l.num, err)
+			}
+			m[key] = v
+		case i < len(lines) && (lines[i].indent > indent || lines[i].indent == indent && isSeqItem(lines[i].text)):
+			v, next, err := parseBlock(lines, i, lines[i].indent)
+			if err != nil {
+				return nil, next, err
+			}
+			m[key], i = v, next
+		default:
+			m[key] = nil
+		}
+	}
+	return m, i, nil
+}
+
+// parseScalar parses a quoted or plain scalar, [a, b] and {} flow values
+func parseScalar(s string) (interface{}, error) {
+	switch {
+	case s == "{}":
+		return map[string]interface{}{}, nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence %s", s)
+		}
+		seq := []interface{}{}
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			v, err := parseScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case s == "~" || s == "null":
+		return nil, nil
+	}
+	return s, nil
+}
+
+// splitFlow splits the items of a flow sequence on the commas outside quotes
+func splitFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+// decodeValue stores the parsed YAML value v in rv, matching struct fields
+// by their json name
+func decodeValue(v interface{}, rv reflect.Value) error {
+	if v == nil {
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return decodeValue(v, rv.Elem())
+	case reflect.String:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %v", v)
+		}
+		rv.SetString(s)
+	case reflect.Bool:
+		s, _ := v.(string)
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %v", v)
+		}
+		rv.SetBool(b)
+	case reflect.Int:
+		s, _ := v.(string)
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %v", v)
+		}
+		rv.SetInt(int64(n))
+	case reflect.Slice:
+		seq, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected a list, got %v", v)
+		}
+		rv.Set(reflect.MakeSlice(rv.Type(), len(seq), len(seq)))
+		for i, item := range seq {
+			if err := decodeValue(item, rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a mapping, got %v", v)
+		}
+		rv.Set(reflect.MakeMap(rv.Type()))
+		for k, item := range m {
+			ev := reflect.New(rv.Type().Elem()).Elem()
+			if err := decodeValue(item, ev); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+			rv.SetMapIndex(reflect.ValueOf(k), ev)
+		}
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a mapping, got %v", v)
+		}
+		t := rv.Type()
+		for k, item := range m {
+			field := -1
+			for i := 0; i < t.NumField(); i++ {
+				if strings.Split(t.Field(i).Tag.Get("json"), ",")[0] == k {
+					field = i
+				}
+			}
+			if field < 0 {
+				return fmt.Errorf("unknown field %s", k)
+			}
+			if err := decodeValue(item, rv.Field(field)); err != nil {
+				return fmt.Errorf("%s: %v", k, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported field type %s", rv.Type())
+	}
+	return nil
+}
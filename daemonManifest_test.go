@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     interface{}
+		err      string
+	}{
+		{name: "empty", in: "# nothing\n---\n", want: map[string]interface{}{}},
+		{
+			name: "nested maps",
+			in:   "name: app\nlimits:\n  nofile: 1024\n  nproc: 64\nhardening:\n  protect_system: full\n",
+			want: map[string]interface{}{
+				"name":      "app",
+				"limits":    map[string]interface{}{"nofile": "1024", "nproc": "64"},
+				"hardening": map[string]interface{}{"protect_system": "full"},
+			},
+		},
+		{
+			name: "flow sequence",
+			in:   `args: [a, "b c", 'd, e']` + "\nempty: []\n",
+			want: map[string]interface{}{"args": []interface{}{"a", "b c", "d, e"}, "empty": []interface{}{}},
+		},
+		{
+			name: "block sequence",
+			in:   "args:\n- --port\n- \"8080\"\nenv:\n  - x\n",
+			want: map[string]interface{}{"args": []interface{}{"--port", "8080"}, "env": []interface{}{"x"}},
+		},
+		{
+			name: "quoted scalars",
+			in:   "a: \"0123\"\nb: '1.0'\nc: 'it''s'\nd: \"tab\\there\"\n\"e f\": ~\n",
+			want: map[string]interface{}{"a": "0123", "b": "1.0", "c": "it's", "d": "tab\there", "e f": nil},
+		},
+		{
+			name: "comments",
+			in:   "# manifest\nname: app # the name\nexec: \"/opt/a#b\"\ndescription: a#b\n  # indented comment\n",
+			want: map[string]interface{}{"name": "app", "exec": "/opt/a#b", "description": "a#b"},
+		},
+		{name: "indented value", in: "name: app\n  exec: /bin/app\n", err: "line 2: bad indentation"},
+		{name: "dedented key", in: "env:\n    A: 1\n  B: 2\n", err: "line 3: bad indentation"},
+		{name: "tab indent", in: "env:\n\tA: 1\n", err: "line 2: tabs"},
+		{name: "no colon", in: "name app\n", err: "line 1: expected key: value"},
+		{name: "item in mapping", in: "name: app\n- x\n", err: "line 2: sequence item in a mapping"},
+		{name: "unterminated flow", in: "args: [a, b\n", err: "line 1: unterminated flow sequence"},
+		{name: "unterminated quote", in: "name: 'app\n", err: "line 1: unterminated string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.in))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, %v, want the error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	yes, no := true, false
+	want := &Manifest{
+		Name:    "app",
+		Exec:    "/opt/app/bin/app",
+		Args:    []string{"--port", "8080", "two words"},
+		Env:     map[string]string{"PORT": "8080"},
+		User:    "app",
+		Limits:  Limits{NoFile: 1024},
+		Enabled: &yes,
+		Running: &no,
+	}
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"app.yaml": `# the app
+name: app
+exec: /opt/app/bin/app
+args: [--port, "8080", "two words"]
+env:
+  PORT: "8080"
+user: app
+limits:
+  nofile: 1024
+enabled: true
+running: false
+`,
+		"app.json": `{"name": "app", "exec": "/opt/app/bin/app", "args": ["--port", "8080", "two words"],
+ "env": {"PORT": "8080"}, "user": "app", "limits": {"nofile": 1024}, "enabled": true, "running": false}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := ReadManifest(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("%s: got %+v, want %+v", name, m, want)
+		}
+	}
+
+	// A value of the wrong kind is reported with the file
+	path := filepath.Join(dir, "bad.yaml")
+	if err := ioutil.WriteFile(path, []byte("enabled: sometimes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(path); err == nil || !strings.Contains(err.Error(), "bad.yaml") {
+		t.Errorf("got %v, want the error of bad.yaml", err)
+	}
+}
@@ -0,0 +1,317 @@
+package daemon
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Package describes the deb or rpm package BuildPackage builds. The package
+// installs the program as /usr/bin/<name> with the systemd unit, the SysV
+// init script and the logrotate conf install would write, and its
+// maintainer scripts enable, start and stop the service.
+type Package struct {
+	// Format is "deb" or "rpm"
+	Format string
+	// Version of the package, like 1.2.0
+	Version string
+	// Arch is the architecture as the format names it, by default the one
+	// the running binary was built for
+	Arch string
+	// Maintainer of the package as "Name <email>"
+	Maintainer string
+	// Output is the file written, by default <name>_<version>_<arch>.deb or
+	// <name>-<version>-1.<arch>.rpm in the current directory
+	Output string
+}
+
+// The architectures GOARCH names in the naming of deb and rpm
+var (
+	debArchs = map[string]string{"amd64": "amd64", "386": "i386", "arm64": "arm64", "arm": "armhf",
+		"ppc64le": "ppc64el", "s390x": "s390x", "riscv64": "riscv64", "mips64le": "mips64el"}
+	rpmArchs = map[string]string{"amd64": "x86_64", "386": "i686", "arm64": "aarch64", "arm": "armv7hl",
+		"ppc64le": "ppc64le", "s390x": "s390x", "riscv64": "riscv64", "mips64le": "mips64el"}
+)
+
+// packageTime is the modification time of the files in the packages this
+// process builds
+var packageTime = time.Now()
+
+// PackageFlags registers the flags of the package verb on fs, for apps that
+// parse the flags themselves
+func PackageFlags(fs *flag.FlagSet, p *Package) {
+	fs.StringVar(&p.Format, "format", p.Format, "package format, deb or rpm")
+	fs.StringVar(&p.Version, "version", p.Version, "package version")
+	fs.StringVar(&p.Arch, "arch", p.Arch, "package architecture, by default the one of the binary")
+	fs.StringVar(&p.Maintainer, "maintainer", p.Maintainer, `package maintainer, "Name <email>"`)
+	fs.StringVar(&p.Output, "out", p.Output, "package file to write")
+}
+
+// Args returns p as the flags PackageFlags parses, ending with "--" so the
+// service arguments that follow are taken as they are. RunCommand takes
+// them before the service arguments.
+func (p *Package) Args() []string {
+	return []string{"--format=" + p.Format, "--version=" + p.Version, "--arch=" + p.Arch,
+		"--maintainer=" + p.Maintainer, "--out=" + p.Output, "--"}
+}
+
+// packageFile is a file, or with os.ModeDir in mode a directory, of a package
+type packageFile struct {
+	path string
+	data []byte
+	mode os.FileMode
+	// config marks the files the administrator may edit, upgrades keep
+	// their changes
+	config bool
+}
+
+// BuildPackage writes the deb or rpm package p of the service conf
+// describes, installed to run with args, and returns the file written. It
+// needs no packaging tools and runs on any host.
+func BuildPackage(conf Config, p Package, args []string) (string, error) {
+	conf.Root, conf.Executor = "", nil
+	exepath, appName, serverName, err := serviceNames(&conf)
+	if err != nil {
+		return "", &codeError{ExitUsage, err}
+	}
+
+	archs := debArchs
+	if p.Format == "rpm" {
+		archs = rpmArchs
+	}
+	switch {
+	case p.Format != "deb" && p.Format != "rpm":
+		err = fmt.Errorf("unknown package format %q, deb or rpm", p.Format)
+	case p.Version == "":
+		err = fmt.Errorf("package needs a --version")
+	case strings.ContainsAny(p.Version, "- \t\n") && p.Format == "rpm":
+		err = fmt.Errorf("rpm version %q may not contain '-' or spaces", p.Version)
+	case p.Arch == "" && archs[runtime.GOARCH] == "":
+		err = fmt.Errorf("no %s architecture for %s, use --arch", p.Format, runtime.GOARCH)
+	}
+	if err != nil {
+		return "", &codeError{ExitUsage, err}
+	}
+	if p.Arch == "" {
+		p.Arch = archs[runtime.GOARCH]
+	}
+	if p.Maintainer == "" {
+		p.Maintainer = "root <root@localhost>"
+	}
+
+	name := packageName(serverName)
+	if p.Output == "" {
+		if p.Format == "deb" {
+			p.Output = fmt.Sprintf("%s_%s_%s.deb", name, p.Version, p.Arch)
+		} else {
+			p.Output = fmt.Sprintf("%s-%s-1.%s.rpm", name, p.Version, p.Arch)
+		}
+	}
+
+	bin := "/usr/bin/" + appName
+	files, err := packageFiles(exepath, bin, serverName, p.Format, &conf, args)
+	if err != nil {
+		return "", err
+	}
+
+	// The scripts are run with "remove" by dpkg and 0 by rpm on removal
+	removing := `[ "$1" = remove ]`
+	if p.Format == "rpm" {
+		removing = `[ "$1" -eq 0 ]`
+	}
+	scripts, err := packageScripts(&conf, serverName, removing)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if p.Format == "deb" {
+		err = writeDeb(&buf, name, &p, &conf, files, scripts)
+	} else {
+		err = writeRPM(&buf, name, &p, &conf, files, scripts)
+	}
+	if err != nil {
+		return "", err
+	}
+	return p.Output, writeFile(p.Output, buf.Bytes(), 0644)
+}
+
+// packageName turns a service name into a package name, lower case letters,
+// digits and '.', '+' and '-'
+func packageName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '.', r == '+', r == '-':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, name)
+}
+
+// packageFiles returns the files of the package: the program from exepath
+// installed as bin, the environment file and the service files rendered for
+// the systemd and SysV backends of the distributions using format
+func packageFiles(exepath, bin, serverName, format string, conf *Config, args []string) ([]packageFile, error) {
+	data, err := ioutil.ReadFile(exepath)
+	if err != nil {
+		return nil, err
+	}
+	files := []packageFile{{bin, data, 0755, false}}
+
+	name := escapeName(serverName, isNameChar)
+	if conf.Instance != "" {
+		name += "@" + conf.Instance
+	}
+
+	// The unit goes to the directory of the units packages ship, the one
+	// install writes to overrides it. The environment file is the one the
+	// init script reads, the unit reads it too.
+	unitDir, envFile := "/lib/systemd/system/", "/etc/default/"+name
+	if format == "rpm" {
+		unitDir, envFile = "/usr/lib/systemd/system/", "/etc/sysconfig/"+name
+	}
+	unit := &systemDaemon{bin, systemdEscape(serverName), conf.Description, []string{"network.target"}, conf}
+	var env []byte
+	if conf.Instance != "" {
+		// The template unit reads the arguments of the instance from the
+		// environment file of the instance
+		envFile, env = unit.instanceEnvPath(), unit.instanceEnv(args)
+		data, err = unit.render(nil)
+	} else {
+		data, err = unit.renderFor(args, envFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	files = append(files,
+		packageFile{unitDir + path.Base(unit.serviceScrpitPath()), withMarker(data), 0644, true},
+		packageFile{envFile, packageEnv(conf, name, env), 0644, true})
+
+	// deb packages get the init script of Debian, rpm ones that of Red Hat
+	script := &systemVDaemon{bin, name, conf.Description, nil, conf}
+	if data, err = script.renderFor(args, format == "deb"); err != nil {
+		return nil, err
+	}
+	files = append(files, packageFile{script.serviceScrpitPath(), withMarker(data), 0755, true})
+
+	if data, err = renderLogRotate(name); err != nil {
+		return nil, err
+	}
+	files = append(files,
+		packageFile{"/etc/logrotate.d/" + name, withMarker(data), 0644, true},
+		packageFile{"/var/log/" + name, nil, os.ModeDir | 0755, false})
+
+	sort.Slice(files, func(i, k int) bool { return files[i].path < files[k].path })
+	return files, nil
+}
+
+// packageEnv returns the environment file of the service name, head and
+// then the environment of the service as the shell assigns it
+func packageEnv(conf *Config, name string, head []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Environment of the %s service\n", name)
+	buf.Write(head)
+	for _, e := range shellEnv(conf.envList()) {
+		buf.WriteString(e + "\n")
+	}
+	return buf.Bytes()
+}
+
+// packageScripts returns the maintainer scripts of the package by name,
+// removing is the shell test telling the scripts of the format a removal
+// from an upgrade
+func packageScripts(conf *Config, serverName, removing string) (map[string][]byte, error) {
+	unit := systemdEscape(serverName)
+	script := escapeName(serverName, isNameChar)
+	if conf.Instance != "" {
+		unit += "@" + conf.Instance
+		script += "@" + conf.Instance
+	}
+
+	scripts := map[string][]byte{}
+	for name, text := range map[string]string{
+		"postinst": PackagePostInstTemplate,
+		"prerm":    PackagePreRmTemplate,
+		"postrm":   PackagePostRmTemplate,
+	} {
+		templ, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := templ.Execute(
+			&buf,
+			&struct {
+				Unit, Script, Removing string
+				AutoStart              bool
+			}{unit, script, removing, conf.AutoStart},
+		); err != nil {
+			return nil, err
+		}
+		scripts[name] = buf.Bytes()
+	}
+	return scripts, nil
+}
+
+// packageDirs returns the parent directories of files, each once and
+// parents first, "/" excluded
+func packageDirs(files []packageFile) []string {
+	seen := map[string]bool{"/": true}
+	var dirs []string
+	var add func(dir string)
+	add = func(dir string) {
+		if seen[dir] {
+			return
+		}
+		seen[dir] = true
+		add(path.Dir(dir))
+		dirs = append(dirs, dir)
+	}
+	for _, f := range files {
+		add(path.Dir(f.path))
+	}
+	return dirs
+}
+
+// runPackage runs the package verb, args are its flags followed by the
+// arguments the service is installed with
+func runPackage(conf *Config, args []string) error {
+	var p Package
+	fs := flag.NewFlagSet("package", flag.ContinueOnError)
+	PackageFlags(fs, &p)
+	if err := fs.Parse(args); err != nil {
+		return &codeError{ExitUsage, err}
+	}
+
+	file, err := BuildPackage(*conf, p, fs.Args())
+	if err != nil {
+		label := conf.Name
+		if _, _, name, nerr := serviceNames(conf); nerr == nil {
+			label = name
+		}
+		err = fmt.Errorf("to package %s err:%w", label, err)
+	}
+	switch {
+	case conf.Output == "json":
+		out := &output{Command: "package", File: file, ExitCode: ExitCode(err)}
+		if err != nil {
+			out.Error = &outputError{err.Error(), out.ExitCode}
+		}
+		printJSON(out)
+	case conf.Quiet || err != nil:
+	default:
+		fmt.Printf("wrote %s\n", file)
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// writeDeb writes the deb package name of files to w: an ar archive of the
+// format version, the control files and the files
+func writeDeb(w io.Writer, name string, p *Package, conf *Config, files []packageFile, scripts map[string][]byte) error {
+	var size int
+	var conffiles, md5sums strings.Builder
+	for _, f := range files {
+		if f.mode.IsDir() {
+			continue
+		}
+		size += len(f.data)
+		if f.config {
+			fmt.Fprintf(&conffiles, "%s\n", f.path)
+		}
+		fmt.Fprintf(&md5sums, "%x  %s\n", md5.Sum(f.data), strings.TrimPrefix(f.path, "/"))
+	}
+
+	var control strings.Builder
+	fmt.Fprintf(&control, "Package: %s\n", name)
+	fmt.Fprintf(&control, "Version: %s\n", p.Version)
+	fmt.Fprintf(&control, "Architecture: %s\n", p.Arch)
+	fmt.Fprintf(&control, "Maintainer: %s\n", p.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (size+1023)/1024)
+	fmt.Fprintf(&control, "Section: misc\n")
+	fmt.Fprintf(&control, "Priority: optional\n")
+	fmt.Fprintf(&control, "Description: %s\n", strings.Join(strings.Fields(conf.Description), " "))
+
+	controlFiles := []packageFile{
+		{"/control", []byte(control.String()), 0644, false},
+		{"/conffiles", []byte(conffiles.String()), 0644, false},
+		{"/md5sums", []byte(md5sums.String()), 0644, false},
+	}
+	for name, data := range scripts {
+		controlFiles = append(controlFiles, packageFile{"/" + name, data, 0755, false})
+	}
+	sort.Slice(controlFiles, func(i, k int) bool { return controlFiles[i].path < controlFiles[k].path })
+
+	controlTar, err := tarGz(controlFiles)
+	if err != nil {
+		return err
+	}
+	dataTar, err := tarGz(files)
+	if err != nil {
+		return err
+	}
+
+	return writeAr(w, []packageFile{
+		{"debian-binary", []byte("2.0\n"), 0644, false},
+		{"control.tar.gz", controlTar, 0644, false},
+		{"data.tar.gz", dataTar, 0644, false},
+	})
+}
+
+// tarGz returns the gzipped tar of files and their parent directories, with
+// the paths relative to "./" as dpkg wants them
+func tarGz(files []packageFile) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	entries := []packageFile{{"/", nil, os.ModeDir | 0755, false}}
+	for _, dir := range packageDirs(files) {
+		entries = append(entries, packageFile{dir, nil, os.ModeDir | 0755, false})
+	}
+	for _, f := range append(entries, files...) {
+		hdr := &tar.Header{
+			Name:    "." + f.path,
+			Mode:    int64(f.mode.Perm()),
+			Size:    int64(len(f.data)),
+			ModTime: packageTime,
+			Uname:   "root",
+			Gname:   "root",
+			Format:  tar.FormatGNU,
+		}
+		if f.mode.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name = strings.TrimSuffix(hdr.Name, "/") + "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAr writes the ar archive of members to w
+func writeAr(w io.Writer, members []packageFile) error {
+	if _, err := io.WriteString(w, "!<arch>\n"); err != nil {
+		return err
+	}
+	for _, m := range members {
+		if _, err := fmt.Fprintf(w, "%-16s%-12d%-6d%-6d%-8o%-10d`\n",
+			m.path, packageTime.Unix(), 0, 0, 0100000|uint32(m.mode.Perm()), len(m.data)); err != nil {
+			return err
+		}
+		if _, err := w.Write(m.data); err != nil {
+			return err
+		}
+		// Members start at even offsets
+		if len(m.data)%2 == 1 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The rpm header entry types
+const (
+	rpmInt16       = 3
+	rpmInt32       = 4
+	rpmString      = 6
+	rpmBin         = 7
+	rpmStringArray = 8
+	rpmI18NString  = 9
+)
+
+// The rpm header tags this package writes, see rpmtag.h
+const (
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+	rpmTagHeaderI18NTable  = 100
+
+	rpmSigTagSHA1        = 269
+	rpmSigTagSHA256      = 273
+	rpmSigTagSize        = 1000
+	rpmSigTagMD5         = 1004
+	rpmSigTagPayloadSize = 1007
+
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagPostIn            = 1024
+	rpmTagPreUn             = 1025
+	rpmTagPostUn            = 1026
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagPostInProg        = 1086
+	rpmTagPreUnProg         = 1087
+	rpmTagPostUnProg        = 1088
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+	rpmTagPayloadDigest     = 5092
+	rpmTagPayloadDigestAlgo = 5093
+)
+
+// The flags of files and dependencies
+const (
+	rpmFileConfig    = 1 << 0
+	rpmFileNoReplace = 1 << 4
+
+	rpmSenseLess   = 1 << 1
+	rpmSenseEqual  = 1 << 3
+	rpmSenseRPMLib = 1 << 24
+
+	// rpmDigestSHA256 is the PGP number of the digest algorithm
+	rpmDigestSHA256 = 8
+)
+
+// rpmEntry is a tag of an rpm header with its value encoded
+type rpmEntry struct {
+	tag, typ, count int
+	data            []byte
+}
+
+// rpmHeader is the list of tags of an rpm header
+type rpmHeader []rpmEntry
+
+// add adds tag of type typ, value is a string, []string, []int16, []int32
+// or []byte
+func (h *rpmHeader) add(tag, typ int, value interface{}) {
+	var buf bytes.Buffer
+	count := 1
+	switch v := value.(type) {
+	case string:
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	case []string:
+		for _, s := range v {
+			buf.WriteString(s)
+			buf.WriteByte(0)
+		}
+		count = len(v)
+	case []int16:
+		binary.Write(&buf, binary.BigEndian, v)
+		count = len(v)
+	case []int32:
+		binary.Write(&buf, binary.BigEndian, v)
+		count = len(v)
+	case []byte:
+		buf.Write(v)
+		count = len(v)
+	}
+	*h = append(*h, rpmEntry{tag, typ, count, buf.Bytes()})
+}
+
+// marshal encodes the header with its tags in an immutable region, the tag
+// region marks it: rpm verifies the index and the data of the region
+func (h rpmHeader) marshal(region int) []byte {
+	sort.SliceStable(h, func(i, k int) bool { return h[i].tag < h[k].tag })
+
+	var index, store bytes.Buffer
+	for _, e := range h {
+		align := 1
+		switch e.typ {
+		case rpmInt16:
+			align = 2
+		case rpmInt32:
+			align = 4
+		}
+		for store.Len()%align != 0 {
+			store.WriteByte(0)
+		}
+		binary.Write(&index, binary.BigEndian, []int32{int32(e.tag), int32(e.typ), int32(store.Len()), int32(e.count)})
+		store.Write(e.data)
+	}
+
+	// The region entry comes first and points at the trailer ending the
+	// data, the trailer holds the size of the index the region spans
+	n := len(h) + 1
+	trailer := store.Len()
+	binary.Write(&store, binary.BigEndian, []int32{int32(region), rpmBin, int32(-n * 16), 16})
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, []int32{int32(n), int32(store.Len())})
+	binary.Write(&buf, binary.BigEndian, []int32{int32(region), rpmBin, int32(trailer), 16})
+	buf.Write(index.Bytes())
+	buf.Write(store.Bytes())
+	return buf.Bytes()
+}
+
+// writeRPM writes the rpm package name of files to w: the lead, the
+// signature header with the digests, the header and the gzipped cpio payload
+func writeRPM(w io.Writer, name string, p *Package, conf *Config, files []packageFile, scripts map[string][]byte) error {
+	payload := cpioNewc(files)
+	var compressed bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&compressed, gzip.BestCompression)
+	if _, err := gz.Write(payload); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	summary := strings.Join(strings.Fields(conf.Description), " ")
+	host, _ := os.Hostname()
+	h := rpmHeader{}
+	h.add(rpmTagHeaderI18NTable, rpmStringArray, []string{"C"})
+	h.add(rpmTagName, rpmString, name)
+	h.add(rpmTagVersion, rpmString, p.Version)
+	h.add(rpmTagRelease, rpmString, "1")
+	h.add(rpmTagSummary, rpmI18NString, summary)
+	h.add(rpmTagDescription, rpmI18NString, summary)
+	h.add(rpmTagBuildTime, rpmInt32, []int32{int32(packageTime.Unix())})
+	h.add(rpmTagBuildHost, rpmString, host)
+	h.add(rpmTagPackager, rpmString, p.Maintainer)
+	h.add(rpmTagGroup, rpmI18NString, "Unspecified")
+	h.add(rpmTagOS, rpmString, "linux")
+	h.add(rpmTagArch, rpmString, p.Arch)
+	h.add(rpmTagSourceRPM, rpmString, fmt.Sprintf("%s-%s-1.src.rpm", name, p.Version))
+
+	h.add(rpmTagPostIn, rpmString, string(scripts["postinst"]))
+	h.add(rpmTagPostInProg, rpmStringArray, []string{"/bin/sh"})
+	h.add(rpmTagPreUn, rpmString, string(scripts["prerm"]))
+	h.add(rpmTagPreUnProg, rpmStringArray, []string{"/bin/sh"})
+	h.add(rpmTagPostUn, rpmString, string(scripts["postrm"]))
+	h.add(rpmTagPostUnProg, rpmStringArray, []string{"/bin/sh"})
+
+	h.add(rpmTagProvideName, rpmStringArray, []string{name})
+	h.add(rpmTagProvideFlags, rpmInt32, []int32{rpmSenseEqual})
+	h.add(rpmTagProvideVersion, rpmStringArray, []string{p.Version + "-1"})
+	h.add(rpmTagRequireName, rpmStringArray, []string{"/bin/sh",
+		"rpmlib(CompressedFileNames)", "rpmlib(FileDigests)", "rpmlib(PayloadFilesHavePrefix)"})
+	rpmlib := int32(rpmSenseRPMLib | rpmSenseLess | rpmSenseEqual)
+	h.add(rpmTagRequireFlags, rpmInt32, []int32{0, rpmlib, rpmlib, rpmlib})
+	h.add(rpmTagRequireVersion, rpmStringArray, []string{"", "3.0.4-1", "4.6.0-1", "4.0-1"})
+
+	var size int32
+	var sizes, mtimes, flags, devices, inodes, dirIndexes []int32
+	var modes, rdevs []int16
+	var digests, linktos, users, langs, baseNames, dirNames []string
+	dirIndex := map[string]int32{}
+	for i, f := range files {
+		mode := 0100000 | uint32(f.mode.Perm())
+		digest := fmt.Sprintf("%x", sha256.Sum256(f.data))
+		if f.mode.IsDir() {
+			mode, digest = 040000|uint32(f.mode.Perm()), ""
+		}
+		var flag int32
+		if f.config {
+			flag = rpmFileConfig | rpmFileNoReplace
+		}
+
+		dir := path.Dir(f.path) + "/"
+		if _, ok := dirIndex[dir]; !ok {
+			dirIndex[dir] = int32(len(dirNames))
+			dirNames = append(dirNames, dir)
+		}
+
+		size += int32(len(f.data))
+		sizes = append(sizes, int32(len(f.data)))
+		modes = append(modes, int16(mode))
+		rdevs = append(rdevs, 0)
+		mtimes = append(mtimes, int32(packageTime.Unix()))
+		digests = append(digests, digest)
+		linktos = append(linktos, "")
+		flags = append(flags, flag)
+		users = append(users, "root")
+		devices = append(devices, 1)
+		inodes = append(inodes, int32(i+1))
+		langs = append(langs, "")
+		dirIndexes = append(dirIndexes, dirIndex[dir])
+		baseNames = append(baseNames, path.Base(f.path))
+	}
+	h.add(rpmTagSize, rpmInt32, []int32{size})
+	h.add(rpmTagFileSizes, rpmInt32, sizes)
+	h.add(rpmTagFileModes, rpmInt16, modes)
+	h.add(rpmTagFileRDevs, rpmInt16, rdevs)
+	h.add(rpmTagFileMTimes, rpmInt32, mtimes)
+	h.add(rpmTagFileDigests, rpmStringArray, digests)
+	h.add(rpmTagFileLinkTos, rpmStringArray, linktos)
+	h.add(rpmTagFileFlags, rpmInt32, flags)
+	h.add(rpmTagFileUserName, rpmStringArray, users)
+	h.add(rpmTagFileGroupName, rpmStringArray, users)
+	h.add(rpmTagFileDevices, rpmInt32, devices)
+	h.add(rpmTagFileInodes, rpmInt32, inodes)
+	h.add(rpmTagFileLangs, rpmStringArray, langs)
+	h.add(rpmTagDirIndexes, rpmInt32, dirIndexes)
+	h.add(rpmTagBaseNames, rpmStringArray, baseNames)
+	h.add(rpmTagDirNames, rpmStringArray, dirNames)
+	h.add(rpmTagFileDigestAlgo, rpmInt32, []int32{rpmDigestSHA256})
+
+	h.add(rpmTagPayloadFormat, rpmString, "cpio")
+	h.add(rpmTagPayloadCompressor, rpmString, "gzip")
+	h.add(rpmTagPayloadFlags, rpmString, "9")
+	h.add(rpmTagPayloadDigest, rpmStringArray, []string{fmt.Sprintf("%x", sha256.Sum256(compressed.Bytes()))})
+	h.add(rpmTagPayloadDigestAlgo, rpmInt32, []int32{rpmDigestSHA256})
+	header := h.marshal(rpmTagHeaderImmutable)
+
+	sum := md5.New()
+	sum.Write(header)
+	sum.Write(compressed.Bytes())
+	sig := rpmHeader{}
+	sig.add(rpmSigTagSHA1, rpmString, fmt.Sprintf("%x", sha1.Sum(header)))
+	sig.add(rpmSigTagSHA256, rpmString, fmt.Sprintf("%x", sha256.Sum256(header)))
+	sig.add(rpmSigTagSize, rpmInt32, []int32{int32(len(header) + compressed.Len())})
+	sig.add(rpmSigTagMD5, rpmBin, sum.Sum(nil))
+	sig.add(rpmSigTagPayloadSize, rpmInt32, []int32{int32(len(payload))})
+	signature := sig.marshal(rpmTagHeaderSignatures)
+	// The header that follows starts at a multiple of 8
+	for len(signature)%8 != 0 {
+		signature = append(signature, 0)
+	}
+
+	// The lead is kept for old tools, rpm reads the headers
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	copy(lead[10:75], fmt.Sprintf("%s-%s-1", name, p.Version))
+	binary.BigEndian.PutUint16(lead[76:], 1) // Linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // signature in a header
+
+	for _, data := range [][]byte{lead, signature, header, compressed.Bytes()} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cpioNewc returns the cpio archive of files in the "newc" format rpm
+// payloads use, with the paths relative to "./"
+func cpioNewc(files []packageFile) []byte {
+	var buf bytes.Buffer
+	pad := func() {
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	entry := func(ino int, name string, mode uint32, nlink int, data []byte) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			ino, mode, 0, 0, nlink, packageTime.Unix(), len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		pad()
+		buf.Write(data)
+		pad()
+	}
+
+	for i, f := range files {
+		if f.mode.IsDir() {
+			entry(i+1, "."+f.path, 040000|uint32(f.mode.Perm()), 2, nil)
+		} else {
+			entry(i+1, "."+f.path, 0100000|uint32(f.mode.Perm()), 1, f.data)
+		}
+	}
+	entry(0, "TRAILER!!!", 0, 1, nil)
+	return buf.Bytes()
+}
@@ -0,0 +1,488 @@
+package daemon
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// buildTestPackage builds the format package of a fake program and returns
+// the package and the program
+func buildTestPackage(t *testing.T, format string) ([]byte, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "app")
+	program := []byte("#!/bin/sh\nexec sleep 300\n")
+	if err := ioutil.WriteFile(exe, program, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{Name: "app", Exec: exe, Description: "Test app", AutoStart: true,
+		Env: map[string]string{"GREETING": "hello world"}}
+	p := Package{Format: format, Version: "1.2.0", Arch: "x86_64", Output: filepath.Join(dir, "app."+format)}
+	file, err := BuildPackage(conf, p, []string{"--port", "8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, program
+}
+
+// tarEntry is a file read back from a tar
+type tarEntry struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+// readTarGz returns the entries of a gzipped tar by name, and the names in
+// order
+func readTarGz(t *testing.T, data []byte) (map[string]tarEntry, []string) {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	entries := map[string]tarEntry{}
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = tarEntry{hdr, body}
+		names = append(names, hdr.Name)
+	}
+	return entries, names
+}
+
+func TestPackageDeb(t *testing.T) {
+	data, program := buildTestPackage(t, "deb")
+
+	// The ar archive: the magic, then a 60 byte header per member, members
+	// start at even offsets
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		t.Fatalf("no ar magic in %q", data[:8])
+	}
+	var members []string
+	contents := map[string][]byte{}
+	for off := 8; off < len(data); {
+		if off+60 > len(data) {
+			t.Fatalf("truncated ar header at %d", off)
+		}
+		hdr := data[off : off+60]
+		if string(hdr[58:60]) != "`\n" {
+			t.Fatalf("bad ar header end %q at %d", hdr[58:60], off)
+		}
+		name := strings.TrimSpace(string(hdr[:16]))
+		size, err := strconv.Atoi(strings.TrimSpace(string(hdr[48:58])))
+		if err != nil || off+60+size > len(data) {
+			t.Fatalf("bad size of ar member %s: %q", name, hdr[48:58])
+		}
+		if mode := strings.TrimSpace(string(hdr[40:48])); mode != "100644" {
+			t.Errorf("ar member %s has mode %s", name, mode)
+		}
+		members = append(members, name)
+		contents[name] = data[off+60 : off+60+size]
+		off += 60 + size + size%2
+	}
+	if want := "debian-binary control.tar.gz data.tar.gz"; strings.Join(members, " ") != want {
+		t.Fatalf("ar members %v, want %s", members, want)
+	}
+	if string(contents["debian-binary"]) != "2.0\n" {
+		t.Errorf("debian-binary is %q", contents["debian-binary"])
+	}
+
+	files, names := readTarGz(t, contents["data.tar.gz"])
+	seen := map[string]bool{}
+	for _, name := range names {
+		// dpkg wants the directories before what they hold
+		trimmed := strings.TrimSuffix(name, "/")
+		if dir := trimmed[:strings.LastIndex(trimmed, "/")+1]; name != "./" && !seen[dir] {
+			t.Errorf("%s comes before its directory %s", name, dir)
+		}
+		seen[name] = true
+	}
+	for name, mode := range map[string]int64{
+		"./usr/bin/app":                    0755,
+		"./lib/systemd/system/app.service": 0644,
+		"./etc/default/app":                0644,
+		"./etc/init.d/app":                 0755,
+		"./etc/logrotate.d/app":            0644,
+		"./var/log/app/":                   0755,
+	} {
+		f, ok := files[name]
+		if !ok {
+			t.Errorf("no %s in the data, got %v", name, names)
+			continue
+		}
+		if f.hdr.Mode != mode {
+			t.Errorf("%s has mode %o, want %o", name, f.hdr.Mode, mode)
+		}
+	}
+	if !bytes.Equal(files["./usr/bin/app"].data, program) {
+		t.Errorf("the packaged program differs")
+	}
+	unit := string(files["./lib/systemd/system/app.service"].data)
+	if !strings.Contains(unit, "EnvironmentFile=-/etc/default/app\n") || !strings.Contains(unit, "ExecStart=/usr/bin/app --port 8080\n") {
+		t.Errorf("unit does not read the environment file or run the program:\n%s", unit)
+	}
+	if env := string(files["./etc/default/app"].data); !strings.Contains(env, "GREETING='hello world'\n") {
+		t.Errorf("environment file lacks the environment:\n%s", env)
+	}
+	if script := string(files["./etc/init.d/app"].data); !strings.Contains(script, "start-stop-daemon") {
+		t.Errorf("deb got the Red Hat init script")
+	}
+
+	control, _ := readTarGz(t, contents["control.tar.gz"])
+	for _, field := range []string{"Package: app\n", "Version: 1.2.0\n", "Architecture: x86_64\n", "Description: Test app\n"} {
+		if !strings.Contains(string(control["./control"].data), field) {
+			t.Errorf("control lacks %q:\n%s", field, control["./control"].data)
+		}
+	}
+	for _, script := range []string{"./postinst", "./prerm", "./postrm"} {
+		if f, ok := control[script]; !ok || f.hdr.Mode != 0755 {
+			t.Errorf("no executable %s in the control files", script)
+		}
+	}
+	conffiles := strings.Fields(string(control["./conffiles"].data))
+	if want := "/etc/default/app /etc/init.d/app /etc/logrotate.d/app /lib/systemd/system/app.service"; strings.Join(conffiles, " ") != want {
+		t.Errorf("conffiles %v, want %s", conffiles, want)
+	}
+
+	// md5sums lists every file with the digest of what the data holds
+	sums := strings.Split(strings.TrimSpace(string(control["./md5sums"].data)), "\n")
+	for _, l := range sums {
+		f := strings.SplitN(l, "  ", 2)
+		if len(f) != 2 {
+			t.Fatalf("bad md5sums line %q", l)
+		}
+		entry, ok := files["./"+f[1]]
+		if !ok {
+			t.Errorf("md5sums lists %s, the data has no such file", f[1])
+		} else if sum := fmt.Sprintf("%x", md5.Sum(entry.data)); sum != f[0] {
+			t.Errorf("md5sum of %s is %s, md5sums says %s", f[1], sum, f[0])
+		}
+	}
+	if len(sums) != 5 {
+		t.Errorf("md5sums lists %d files, want 5", len(sums))
+	}
+}
+
+// rpmTag is a tag read back from an rpm header
+type rpmTag struct {
+	typ, count int
+	data       []byte
+}
+
+// readRPMHeader checks the header at the start of data and its region
+// marked by the region tag, and returns its tags and its size
+func readRPMHeader(t *testing.T, data []byte, region int) (map[int]rpmTag, int) {
+	t.Helper()
+	if len(data) < 16 || !bytes.Equal(data[:8], []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}) {
+		t.Fatalf("no header magic")
+	}
+	n := int(binary.BigEndian.Uint32(data[8:]))
+	storeSize := int(binary.BigEndian.Uint32(data[12:]))
+	size := 16 + n*16 + storeSize
+	if size > len(data) {
+		t.Fatalf("header of %d tags and %d bytes of data is truncated", n, storeSize)
+	}
+	store := data[16+n*16 : size]
+
+	tags := map[int]rpmTag{}
+	last := -1
+	for i := 0; i < n; i++ {
+		e := data[16+i*16:]
+		tag := int(int32(binary.BigEndian.Uint32(e)))
+		typ := int(binary.BigEndian.Uint32(e[4:]))
+		off := int(int32(binary.BigEndian.Uint32(e[8:])))
+		count := int(binary.BigEndian.Uint32(e[12:]))
+
+		if i == 0 {
+			// The region tag points at the trailer, which spans the index
+			if tag != region || typ != rpmBin || count != 16 || off+16 > len(store) {
+				t.Fatalf("first tag %d type %d count %d offset %d, want the region %d", tag, typ, count, off, region)
+			}
+			tr := store[off : off+16]
+			if int(binary.BigEndian.Uint32(tr)) != region || binary.BigEndian.Uint32(tr[4:]) != rpmBin ||
+				int(int32(binary.BigEndian.Uint32(tr[8:]))) != -n*16 || binary.BigEndian.Uint32(tr[12:]) != 16 {
+				t.Fatalf("bad region trailer %x", tr)
+			}
+			if off+16 != len(store) {
+				t.Errorf("the region trailer ends at %d, the data at %d", off+16, len(store))
+			}
+			continue
+		}
+		if tag <= last {
+			t.Errorf("tag %d follows tag %d, rpm wants them sorted", tag, last)
+		}
+		last = tag
+
+		// The size of the value, integers are aligned to their size
+		var width int
+		switch typ {
+		case rpmInt16:
+			width = 2 * count
+		case rpmInt32:
+			width = 4 * count
+		case rpmBin:
+			width = count
+		case rpmString, rpmI18NString, rpmStringArray:
+			end := off
+			for k := 0; k < count; k++ {
+				z := bytes.IndexByte(store[end:], 0)
+				if z < 0 {
+					t.Fatalf("tag %d has an unterminated string", tag)
+				}
+				end += z + 1
+			}
+			width = end - off
+			if typ == rpmString && count != 1 {
+				t.Errorf("string tag %d has count %d", tag, count)
+			}
+		default:
+			t.Fatalf("tag %d has type %d", tag, typ)
+		}
+		if align := map[int]int{rpmInt16: 2, rpmInt32: 4}[typ]; align > 0 && off%align != 0 {
+			t.Errorf("tag %d of type %d at unaligned offset %d", tag, typ, off)
+		}
+		if off < 0 || off+width > len(store) {
+			t.Fatalf("tag %d at %d+%d is out of the data of %d bytes", tag, off, width, len(store))
+		}
+		tags[tag] = rpmTag{typ, count, store[off : off+width]}
+	}
+	return tags, size
+}
+
+func (e rpmTag) strings() []string {
+	return strings.Split(strings.TrimSuffix(string(e.data), "\x00"), "\x00")
+}
+
+func (e rpmTag) int32s() []int32 {
+	v := make([]int32, e.count)
+	binary.Read(bytes.NewReader(e.data), binary.BigEndian, v)
+	return v
+}
+
+func (e rpmTag) uint16s() []uint16 {
+	v := make([]uint16, e.count)
+	binary.Read(bytes.NewReader(e.data), binary.BigEndian, v)
+	return v
+}
+
+// cpioEntry is a file read back from a cpio archive
+type cpioEntry struct {
+	name string
+	mode uint32
+	data []byte
+}
+
+// readCpioNewc reads a cpio archive in the "newc" format up to its trailer
+func readCpioNewc(t *testing.T, data []byte) []cpioEntry {
+	t.Helper()
+	var entries []cpioEntry
+	for off := 0; ; {
+		if off+110 > len(data) || string(data[off:off+6]) != "070701" {
+			t.Fatalf("no newc header at %d", off)
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(data[off+6+i*8:off+14+i*8]), 16, 32)
+			if err != nil {
+				t.Fatalf("bad cpio header field %d at %d: %v", i, off, err)
+			}
+			return int(v)
+		}
+		mode, size, nameSize := field(1), field(6), field(11)
+		nameEnd := off + 110 + nameSize
+		if nameEnd > len(data) || data[nameEnd-1] != 0 {
+			t.Fatalf("bad cpio name at %d", off)
+		}
+		name := string(data[off+110 : nameEnd-1])
+		start := (nameEnd + 3) &^ 3
+		if start+size > len(data) {
+			t.Fatalf("cpio entry %s is truncated", name)
+		}
+		if name == "TRAILER!!!" {
+			return entries
+		}
+		entries = append(entries, cpioEntry{name, uint32(mode), data[start : start+size]})
+		off = (start + size + 3) &^ 3
+	}
+}
+
+func TestPackageRPM(t *testing.T) {
+	data, program := buildTestPackage(t, "rpm")
+
+	if len(data) < 96 || !bytes.Equal(data[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatal("no rpm lead")
+	}
+	if sigType := binary.BigEndian.Uint16(data[78:]); sigType != 5 {
+		t.Errorf("lead signature type %d, want 5", sigType)
+	}
+	sig, sigSize := readRPMHeader(t, data[96:], rpmTagHeaderSignatures)
+	off := 96 + (sigSize+7)&^7
+	tags, headerSize := readRPMHeader(t, data[off:], rpmTagHeaderImmutable)
+	header := data[off : off+headerSize]
+	compressed := data[off+headerSize:]
+
+	// The signature holds the digests and sizes rpm checks
+	sum := md5.New()
+	sum.Write(header)
+	sum.Write(compressed)
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tag, want := range map[int]string{
+		rpmSigTagSHA1:   fmt.Sprintf("%x", sha1.Sum(header)),
+		rpmSigTagSHA256: fmt.Sprintf("%x", sha256.Sum256(header)),
+	} {
+		if got := sig[tag].strings()[0]; got != want {
+			t.Errorf("signature tag %d is %s, want %s", tag, got, want)
+		}
+	}
+	if !bytes.Equal(sig[rpmSigTagMD5].data, sum.Sum(nil)) {
+		t.Errorf("signature md5 %x, want %x", sig[rpmSigTagMD5].data, sum.Sum(nil))
+	}
+	if got := sig[rpmSigTagSize].int32s()[0]; int(got) != headerSize+len(compressed) {
+		t.Errorf("signature size %d, want %d", got, headerSize+len(compressed))
+	}
+	if got := sig[rpmSigTagPayloadSize].int32s()[0]; int(got) != len(payload) {
+		t.Errorf("signature payload size %d, want %d", got, len(payload))
+	}
+	if got := tags[rpmTagPayloadDigest].strings()[0]; got != fmt.Sprintf("%x", sha256.Sum256(compressed)) {
+		t.Errorf("payload digest %s is not that of the payload", got)
+	}
+
+	for tag, want := range map[int]string{rpmTagName: "app", rpmTagVersion: "1.2.0", rpmTagRelease: "1",
+		rpmTagArch: "x86_64", rpmTagOS: "linux", rpmTagPayloadFormat: "cpio", rpmTagPayloadCompressor: "gzip"} {
+		if got := tags[tag].strings()[0]; got != want {
+			t.Errorf("tag %d is %q, want %q", tag, got, want)
+		}
+	}
+
+	// The file list of the header matches the payload
+	dirNames, baseNames := tags[rpmTagDirNames].strings(), tags[rpmTagBaseNames].strings()
+	dirIndexes, sizes := tags[rpmTagDirIndexes].int32s(), tags[rpmTagFileSizes].int32s()
+	modes, digests := tags[rpmTagFileModes].uint16s(), tags[rpmTagFileDigests].strings()
+	flags := tags[rpmTagFileFlags].int32s()
+	entries := readCpioNewc(t, payload)
+	if len(baseNames) != len(entries) {
+		t.Fatalf("header lists %d files, the payload holds %d", len(baseNames), len(entries))
+	}
+	for _, tag := range []int{rpmTagFileSizes, rpmTagFileModes, rpmTagFileRDevs, rpmTagFileMTimes, rpmTagFileDigests,
+		rpmTagFileLinkTos, rpmTagFileFlags, rpmTagFileUserName, rpmTagFileGroupName, rpmTagFileDevices,
+		rpmTagFileInodes, rpmTagFileLangs, rpmTagDirIndexes} {
+		if tags[tag].count != len(entries) {
+			t.Errorf("file tag %d has %d values for %d files", tag, tags[tag].count, len(entries))
+		}
+	}
+
+	files := map[string][]byte{}
+	for i, e := range entries {
+		name := dirNames[dirIndexes[i]] + baseNames[i]
+		if e.name != "."+name {
+			t.Errorf("file %d is %s in the header, %s in the payload", i, name, e.name)
+		}
+		if uint32(modes[i]) != e.mode {
+			t.Errorf("%s has mode %o in the header, %o in the payload", name, modes[i], e.mode)
+		}
+		if int(sizes[i]) != len(e.data) {
+			t.Errorf("%s has size %d in the header, %d in the payload", name, sizes[i], len(e.data))
+		}
+		digest := ""
+		if e.mode&0170000 == 0100000 {
+			digest = fmt.Sprintf("%x", sha256.Sum256(e.data))
+		}
+		if digests[i] != digest {
+			t.Errorf("%s has digest %q in the header, want %q", name, digests[i], digest)
+		}
+		config := strings.HasPrefix(name, "/etc/") || strings.HasPrefix(name, "/usr/lib/systemd/")
+		if got := flags[i]&rpmFileConfig != 0; got != config {
+			t.Errorf("%s is config %v, want %v", name, got, config)
+		}
+		files[name] = e.data
+	}
+
+	for name, mode := range map[string]uint32{
+		"/usr/bin/app":                        0100755,
+		"/usr/lib/systemd/system/app.service": 0100644,
+		"/etc/sysconfig/app":                  0100644,
+		"/etc/init.d/app":                     0100755,
+		"/etc/logrotate.d/app":                0100644,
+		"/var/log/app":                        040755,
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("no %s in the payload", name)
+		}
+		for i, e := range entries {
+			if e.name == "."+name && e.mode != mode {
+				t.Errorf("%s has mode %o, want %o", name, modes[i], mode)
+			}
+		}
+	}
+	if !bytes.Equal(files["/usr/bin/app"], program) {
+		t.Errorf("the packaged program differs")
+	}
+	if unit := string(files["/usr/lib/systemd/system/app.service"]); !strings.Contains(unit, "EnvironmentFile=-/etc/sysconfig/app\n") {
+		t.Errorf("unit does not read the environment file:\n%s", unit)
+	}
+	if script := string(files["/etc/init.d/app"]); !strings.Contains(script, "/etc/rc.d/init.d/functions") {
+		t.Errorf("rpm got the Debian init script")
+	}
+	for _, tag := range []int{rpmTagPostIn, rpmTagPreUn, rpmTagPostUn} {
+		if script := tags[tag].strings()[0]; !strings.HasPrefix(script, "#!/bin/sh\n") {
+			t.Errorf("script tag %d is %q", tag, script)
+		}
+	}
+}
+
+func TestPackageInstanceEnv(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "app")
+	if err := ioutil.WriteFile(exe, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := &Config{Name: "app", Instance: "a", Env: map[string]string{"K": "v"}}
+	files, err := packageFiles(exe, "/usr/bin/app", "app", "deb", conf, []string{"--port", "8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]string{}
+	for _, f := range files {
+		paths[f.path] = string(f.data)
+	}
+	if _, ok := paths["/lib/systemd/system/app@.service"]; !ok {
+		t.Errorf("no template unit in %v", files)
+	}
+	env, ok := paths["/etc/default/app@a"]
+	if !ok || !strings.Contains(env, "DAEMON_ARGS=") || !strings.Contains(env, "K='v'\n") {
+		t.Errorf("instance environment file is %q, want the arguments and the environment", env)
+	}
+}
@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The variables Ready finds the init system to notify by
+const (
+	notifySocketEnv = "NOTIFY_SOCKET"
+	notifyFDEnv     = "DAEMON_NOTIFY_FD"
+)
+
+// Ready tells the init system the service is ready to serve, for services
+// installed with Config.Notify. It sends READY=1 to the systemd notify
+// socket and writes the line s6 waits for to the notification fd. Elsewhere,
+// or when the process was not started as a service, it does nothing.
+func Ready() error {
+	if path := os.Getenv(notifySocketEnv); path != "" {
+		if err := sdNotify(path, "READY=1"); err != nil {
+			return fmt.Errorf("to notify systemd err:%w", err)
+		}
+	}
+
+	v := os.Getenv(notifyFDEnv)
+	if v == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("to notify s6 err:%s=%q is no fd", notifyFDEnv, v)
+	}
+
+	// s6 reads one line, the fd is closed after it and the processes the
+	// app starts must not write to it
+	os.Unsetenv(notifyFDEnv)
+	f := os.NewFile(uintptr(fd), "notification-fd")
+	_, err = f.Write([]byte("\n"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("to notify s6 err:%w", err)
+	}
+	return nil
+}
+
+// sdNotify sends state to the systemd notify socket at path
+func sdNotify(path, state string) error {
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -13,10 +13,43 @@ var (
 	<key>ProgramArguments</key>
 	<array>
 	    <string>{{.Path}}</string>
-		{{range .Args}}<string>{{.}}</string>{{end}}
+		{{range .Args}}<string>{{html .}}</string>{{end}}
 	</array>
+	<key>EnvironmentVariables</key>
+	<dict>
+		<key>DAEMON_SERVICE</key>
+		<string>{{.Name}}</string>
+		{{if .Instance}}<key>DAEMON_INSTANCE</key>
+		<string>{{.Instance}}</string>
+		{{end}}
+		{{- range $k, $v := .Env}}
+		<key>{{html $k}}</key>
+		<string>{{html $v}}</string>
+		{{- end}}
+	</dict>
+	{{- if .User}}
+	<key>UserName</key>
+	<string>{{.User}}</string>
+	{{- end}}
+	{{- if .Group}}
+	<key>GroupName</key>
+	<string>{{.Group}}</string>
+	{{- end}}
+	{{- if or .Limits.NoFile .Limits.NProc}}
+	<key>SoftResourceLimits</key>
+	<dict>
+		{{- if .Limits.NoFile}}
+		<key>NumberOfFiles</key>
+		<integer>{{.Limits.NoFile}}</integer>
+		{{- end}}
+		{{- if .Limits.NProc}}
+		<key>NumberOfProcesses</key>
+		<integer>{{.Limits.NProc}}</integer>
+		{{- end}}
+	</dict>
+	{{- end}}
 	<key>RunAtLoad</key>
-	<true/>
+	{{if .AutoStart}}<true/>{{else}}<false/>{{end}}
     <key>WorkingDirectory</key>
     <string>/usr/local/var</string>
     <key>StandardErrorPath</key>
@@ -36,26 +69,79 @@ name="{{.Name}}"
 rcvar="{{.Name}}_enable"
 command="{{.Path}}"
 pidfile="/var/run/$name.pid"
+export DAEMON_SERVICE="{{.Name}}"
+{{if .Instance}}export DAEMON_INSTANCE="{{.Instance}}"
+{{end}}
+{{- range .Env}}
+export {{.}}
+{{- end}}
+
 
-start_cmd="cd {{.WorkDir}} && /usr/sbin/daemon -p $pidfile -f $command {{.Args}}"
+start_cmd="cd {{.WorkDir}}{{if .Limits.NoFile}} && ulimit -n {{.Limits.NoFile}}{{end}}{{if .Limits.NProc}} && ulimit -u {{.Limits.NProc}}{{end}} && /usr/sbin/daemon -p $pidfile{{if .User}} -u {{.User}}{{end}} -f $command {{.Args}}"
 load_rc_config $name
 run_rc_command "$1"
 `
 
 	//LinuxSystemDTemplate for Linux super systemctl service template
+	//with .Template set it renders the <name>@.service unit shared by all instances
 	LinuxSystemDTemplate = `[Unit]
-Description={{.Description}}
+Description={{.Description}}{{if .Template}} %i{{end}}
 Requires={{.Dependencies}}
 After={{.Dependencies}}
 
 [Service]
+{{- if .Notify}}
+Type=notify
+{{- end}}
 WorkingDirectory={{.WorkDir}}
+Environment=DAEMON_SERVICE={{.Name}}{{if .Template}}@%i{{end}}
+{{- if .Template}}
+Environment=DAEMON_INSTANCE=%i
+EnvironmentFile=-/etc/default/{{.Name}}@%i
+PIDFile=/var/run/{{.Name}}@%i.pid
+{{- else}}
+{{- if .EnvFile}}
+EnvironmentFile=-{{.EnvFile}}
+{{- end}}
 PIDFile=/var/run/{{.Name}}.pid
-User=root
-Group=root
-ExecStartPre=/bin/rm -f /var/run/{{.Name}}.pid
+{{- end}}
+{{- range .Env}}
+Environment={{.}}
+{{- end}}
+User={{.User}}
+{{- if .Group}}
+Group={{.Group}}
+{{- end}}
+{{- if .Limits.NoFile}}
+LimitNOFILE={{.Limits.NoFile}}
+{{- end}}
+{{- if .Limits.NProc}}
+LimitNPROC={{.Limits.NProc}}
+{{- end}}
+{{- with .Hardening}}
+{{- if .NoNewPrivileges}}
+NoNewPrivileges=yes
+{{- end}}
+{{- if .PrivateTmp}}
+PrivateTmp=yes
+{{- end}}
+{{- if .ProtectSystem}}
+ProtectSystem={{.ProtectSystem}}
+{{- end}}
+{{- if .ProtectHome}}
+ProtectHome={{.ProtectHome}}
+{{- end}}
+{{- range .ReadWritePaths}}
+ReadWritePaths={{.}}
+{{- end}}
+{{- end}}
+ExecStartPre=/bin/rm -f /var/run/{{.Name}}{{if .Template}}@%i{{end}}.pid
+{{- if .Template}}
+ExecStart=/bin/sh -c 'eval "set -- $$DAEMON_ARGS"; exec "$$0" "$$@"' {{.Path}}
+{{- else}}
 ExecStart={{.Path}} {{.Args}}
-ExecStopPost=/bin/rm -f /var/run/{{.Name}}.pid
+{{- end}}
+ExecStopPost=/bin/rm -f /var/run/{{.Name}}{{if .Template}}@%i{{end}}.pid
 Restart=always
 RestartSec=5
 
@@ -67,27 +153,64 @@ WantedBy=multi-user.target
 	LinuxUpTemplate = `# {{.Name}} {{.Description}}
 
 description     "{{.Description}}"
-author          "nomadli <dzym79@qq.com>"
 
 start on runlevel [2345]
 stop on runlevel [016]
 
-#expect fork
-
 respawn
 respawn limit 10 5
+{{- if .KillTimeout}}
+kill timeout {{.KillTimeout}}
+{{- end}}
+{{- if .NormalExit}}
+normal exit {{.NormalExit}}
+{{- end}}
 
+console log
 chdir {{.WorkDir}}
+{{- if .User}}
+setuid {{.User}}
+{{- end}}
+{{- if .Group}}
+setgid {{.Group}}
+{{- end}}
 
-script
-    exec {{.Path}} {{.Args}} 2>&1 >> /var/log/{{.Name}}/{{.Name}}.log
+env DAEMON_SERVICE={{.Name}}
+{{- if .Instance}}
+env DAEMON_INSTANCE={{.Instance}}
+{{- end}}
+{{- range .Env}}
+env {{.}}
+{{- end}}
+{{- if .Limits.NoFile}}
+limit nofile {{.Limits.NoFile}} {{.Limits.NoFile}}
+{{- end}}
+{{- if .Limits.NProc}}
+limit nproc {{.Limits.NProc}} {{.Limits.NProc}}
+{{- end}}
+{{- if .PreStart}}
+
+pre-start script
+{{.PreStart}}
 end script
+{{- end}}
+
+exec {{.Path}}{{if .Args}} {{.Args}}{{end}}
 `
 
 	//LinuxSystemVTemplate for Linux super systemV service template
 	LinuxSystemVTemplate = `#! /bin/sh
 # chkconfig: 2345 98 17
 # description: Starts and stops a single {{.Name}} instance on this system
+### BEGIN INIT INFO
+# Provides:          {{.Name}}
+# Required-Start:    $remote_fs $network $syslog
+# Required-Stop:     $remote_fs $network $syslog
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: {{.Description}}
+# Description:       Starts and stops a single {{.Name}} instance on this system
+### END INIT INFO
 
 
 if [ -f /etc/rc.d/init.d/functions ]; then
@@ -101,6 +224,7 @@ proc="{{.Name}}"
 pidfile="/var/run/$proc.pid"
 lockfile="/var/lock/subsys/$proc"
 logfile="/var/log/{{.Name}}/$proc.log"
+DAEMON_ARGS="{{.Args}}"
 
 [ -d $(dirname $lockfile) ] || mkdir -p $(dirname $lockfile)
 
@@ -108,6 +232,33 @@ logfile="/var/log/{{.Name}}/$proc.log"
 
 [ -e /etc/sysconfig/$proc ] && . /etc/sysconfig/$proc
 
+export DAEMON_SERVICE="$proc"
+{{- if .Instance}}
+export DAEMON_INSTANCE="{{.Instance}}"
+{{- end}}
+{{- range .Env}}
+export {{.}}
+{{- end}}
+
+# runas runs the shell script $1 as the service user. Only the su of
+# util-linux takes a group, runuser, setpriv or chroot set it elsewhere and
+# the plain su runs the script with the primary group of the user.
+runas() {
+    {{- if .Group}}
+    if command -v runuser >/dev/null 2>&1; then
+        runuser -s /bin/sh -g {{.Group}} {{.User}} -c "$1"
+    elif command -v setpriv >/dev/null 2>&1; then
+        setpriv --reuid={{.User}} --regid={{.Group}} --init-groups /bin/sh -c "$1"
+    elif command -v chroot >/dev/null 2>&1; then
+        chroot --userspec={{.User}}:{{.Group}} / /bin/sh -c "$1"
+    else
+        su -s /bin/sh {{.User}} -c "$1"
+    fi
+    {{- else}}
+    su -s /bin/sh {{.User}} -c "$1"
+    {{- end}}
+}
+
 start() {
     [ -x $exec ] || exit 5
 
@@ -123,9 +274,18 @@ start() {
     if ! [ -f $pidfile ]; then
         printf "Starting $servname:\t"
         echo "$(date)" >> $logfile
-        su root -c cd {{.WorkDir}}
-        su root -c $exec {{.Args}} 2>&1 >> $logfile &
-        echo $! > $pidfile
+        {{- if .Limits.NoFile}}
+        ulimit -n {{.Limits.NoFile}}
+        {{- end}}
+        {{- if .Limits.NProc}}
+        ulimit -u {{.Limits.NProc}}
+        {{- end}}
+        chown {{.User}}{{if .Group}}:{{.Group}}{{end}} $logfile
+        # The shell runas runs starts the app in WorkDir and prints its PID,
+        # an exec in the background keeps the PID of the job
+        runas "cd \"{{.WorkDir}}\" || exit 1
+            exec \"$exec\" $DAEMON_ARGS >> \"$logfile\" 2>&1 < /dev/null &
+            echo \$!" > $pidfile
         touch $lockfile
         success
         echo
@@ -179,6 +339,213 @@ case "$1" in
 esac
 
 exit $?
+`
+	//LinuxSystemVDebianTemplate for Debian and Ubuntu SysV init scripts, they
+	//use the LSB functions and start-stop-daemon instead of the Red Hat functions
+	LinuxSystemVDebianTemplate = `#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          {{.Name}}
+# Required-Start:    $remote_fs $network $syslog
+# Required-Stop:     $remote_fs $network $syslog
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: {{.Description}}
+# Description:       Starts and stops a single {{.Name}} instance on this system
+### END INIT INFO
+
+. /lib/lsb/init-functions
+
+exec="{{.Path}}"
+servname="{{.Description}}"
+
+proc="{{.Name}}"
+pidfile="/var/run/$proc.pid"
+logfile="/var/log/{{.Name}}/$proc.log"
+DAEMON_ARGS="{{.Args}}"
+
+[ -r /etc/default/$proc ] && . /etc/default/$proc
+
+export DAEMON_SERVICE="$proc"
+{{- if .Instance}}
+export DAEMON_INSTANCE="{{.Instance}}"
+{{- end}}
+{{- range .Env}}
+export {{.}}
+{{- end}}
+
+start() {
+    [ -x "$exec" ] || exit 5
+    mkdir -p "$(dirname "$logfile")"
+    touch "$logfile"
+    chown {{.User}}{{if .Group}}:{{.Group}}{{end}} "$logfile"
+    {{- if .Limits.NoFile}}
+    ulimit -n {{.Limits.NoFile}}
+    {{- end}}
+    {{- if .Limits.NProc}}
+    ulimit -p {{.Limits.NProc}}
+    {{- end}}
+    # sh execs the app, so the pidfile holds its PID
+    start-stop-daemon --start --quiet --background --make-pidfile --pidfile "$pidfile" \
+        --chuid {{.User}}{{if .Group}}:{{.Group}}{{end}} --chdir "{{.WorkDir}}" \
+        --startas /bin/sh -- -c "exec \"$exec\" $DAEMON_ARGS >> \"$logfile\" 2>&1"
+}
+
+stop() {
+    start-stop-daemon --stop --quiet --retry=TERM/10/KILL/5 --pidfile "$pidfile"
+    retval=$?
+    # 1 is nothing to stop
+    [ $retval -eq 1 ] && retval=0
+    [ $retval -eq 0 ] && rm -f "$pidfile"
+    return $retval
+}
+
+running() {
+    start-stop-daemon --status --pidfile "$pidfile"
+}
+
+case "$1" in
+    start)
+        running && exit 0
+        log_daemon_msg "Starting $servname" "$proc"
+        start
+        log_end_msg $?
+        ;;
+    stop)
+        running || exit 0
+        log_daemon_msg "Stopping $servname" "$proc"
+        stop
+        log_end_msg $?
+        ;;
+    restart|force-reload)
+        log_daemon_msg "Restarting $servname" "$proc"
+        stop && start
+        log_end_msg $?
+        ;;
+    status)
+        status_of_proc -p "$pidfile" "$exec" "$proc"
+        ;;
+    *)
+        echo "Usage: $0 {start|stop|status|restart|force-reload}"
+        exit 2
+esac
+
+exit $?
+`
+	//LinuxOpenRCTemplate for Linux OpenRC service template, supervise-daemon
+	//runs the app and restarts it when it exits
+	LinuxOpenRCTemplate = `#!/sbin/openrc-run
+
+name="{{.Name}}"
+description="{{.Description}}"
+supervisor=supervise-daemon
+command="{{.Path}}"
+command_args="{{.Args}}"
+command_user="{{.User}}{{if .Group}}:{{.Group}}{{end}}"
+directory="{{.WorkDir}}"
+pidfile="/run/${RC_SVCNAME}.pid"
+output_log="/var/log/{{.Name}}/{{.Name}}.log"
+error_log="/var/log/{{.Name}}/{{.Name}}.log"
+respawn_delay=5
+{{- if or .Limits.NoFile .Limits.NProc}}
+rc_ulimit="{{if .Limits.NoFile}}-n {{.Limits.NoFile}}{{end}}{{if and .Limits.NoFile .Limits.NProc}} {{end}}{{if .Limits.NProc}}-u {{.Limits.NProc}}{{end}}"
+{{- end}}
+
+export DAEMON_SERVICE="{{.Name}}"
+{{- if .Instance}}
+export DAEMON_INSTANCE="{{.Instance}}"
+{{- end}}
+{{- range .Env}}
+export {{.}}
+{{- end}}
+
+depend() {
+    need net
+    use logger
+}
+
+start_pre() {
+    checkpath --directory --owner "$command_user" /var/log/{{.Name}}
+}
+`
+	// LinuxRunitTemplate for the run script of a runit service, DAEMON_ARGS
+	// records the arguments for status
+	LinuxRunitTemplate = `#!/bin/sh
+exec 2>&1
+
+export DAEMON_SERVICE="{{.Name}}"
+{{- if .Instance}}
+export DAEMON_INSTANCE="{{.Instance}}"
+{{- end}}
+{{- range .Env}}
+export {{.}}
+{{- end}}
+
+DAEMON_ARGS="{{.Args}}"
+eval "set -- $DAEMON_ARGS"
+cd "{{.WorkDir}}"
+exec chpst -u {{.User}}{{if .Group}}:{{.Group}}{{end}}{{if .Limits.NoFile}} -o {{.Limits.NoFile}}{{end}}{{if .Limits.NProc}} -p {{.Limits.NProc}}{{end}} "{{.Path}}" "$@"
+`
+	// LinuxRunitLogTemplate for the log/run script of a runit service, svlogd
+	// rotates the log itself
+	LinuxRunitLogTemplate = `#!/bin/sh
+mkdir -p /var/log/{{.Name}}
+exec svlogd -tt /var/log/{{.Name}}
+`
+	// LinuxS6Template for the run script of an s6 service, DAEMON_ARGS
+	// records the arguments for status and DAEMON_NOTIFY_FD tells Ready the
+	// notification fd
+	LinuxS6Template = `#!/bin/sh
+exec 2>&1
+
+export DAEMON_SERVICE="{{.Name}}"
+{{- if .Instance}}
+export DAEMON_INSTANCE="{{.Instance}}"
+{{- end}}
+{{- if .Notify}}
+export DAEMON_NOTIFY_FD=3
+{{- end}}
+{{- range .Env}}
+export {{.}}
+{{- end}}
+
+DAEMON_ARGS="{{.Args}}"
+eval "set -- $DAEMON_ARGS"
+cd "{{.WorkDir}}"
+exec {{if or .Limits.NoFile .Limits.NProc}}s6-softlimit{{if .Limits.NoFile}} -o {{.Limits.NoFile}}{{end}}{{if .Limits.NProc}} -p {{.Limits.NProc}}{{end}} {{end}}s6-envuidgid {{.User}}{{if .Group}}:{{.Group}}{{end}} s6-applyuidgid -U "{{.Path}}" "$@"
+`
+	// LinuxS6FinishTemplate for the finish script of an s6 service, it logs
+	// how the run script exited
+	LinuxS6FinishTemplate = `#!/bin/sh
+if [ "$1" = 256 ]; then
+    echo "{{.Name}} killed by signal $2"
+else
+    echo "{{.Name}} exited with status $1"
+fi
+`
+	// LinuxS6LogTemplate for the log/run script of an s6 service, s6-log
+	// rotates the log itself
+	LinuxS6LogTemplate = `#!/bin/sh
+mkdir -p /var/log/{{.Name}}
+exec s6-log -b n10 s1000000 T /var/log/{{.Name}}
+`
+	// LinuxSupervisorTemplate for the program file of supervisord, which
+	// rotates the log itself
+	LinuxSupervisorTemplate = `[program:{{.Name}}]
+command={{.Command}}
+directory={{.WorkDir}}
+{{- if .User}}
+user={{.User}}
+{{- end}}
+environment={{.Environment}}
+autostart={{.AutoStart}}
+autorestart=true
+startsecs=1
+stopasgroup=true
+killasgroup=true
+redirect_stderr=true
+stdout_logfile=/var/log/{{.Name}}/{{.Name}}.log
+stdout_logfile_maxbytes=10MB
+stdout_logfile_backups=10
 `
 	// LinuxLogRotateTemplate for logrotate template
 	LinuxLogRotateTemplate = `
@@ -193,5 +560,66 @@ exit $?
     missingok
     su root root
 }
+`
+
+	// PackagePostInstTemplate for the script deb and rpm packages run after
+	// they are installed or upgraded, it enables and (re)starts the service
+	PackagePostInstTemplate = `#!/bin/sh
+set -e
+
+if [ -d /run/systemd/system ]; then
+    systemctl daemon-reload
+fi
+if command -v systemctl >/dev/null 2>&1; then
+    {{- if .AutoStart}}
+    systemctl enable {{.Unit}}
+    {{- end}}
+    if [ -d /run/systemd/system ]; then
+        systemctl restart {{.Unit}}
+    fi
+elif command -v update-rc.d >/dev/null 2>&1; then
+    update-rc.d {{.Script}} {{if .AutoStart}}defaults{{else}}defaults-disabled{{end}}
+    /etc/init.d/{{.Script}} restart
+elif command -v chkconfig >/dev/null 2>&1; then
+    chkconfig --add {{.Script}}
+    {{- if not .AutoStart}}
+    chkconfig {{.Script}} off
+    {{- end}}
+    /etc/init.d/{{.Script}} restart
+fi
+`
+
+	// PackagePreRmTemplate for the script deb and rpm packages run before
+	// they are removed or upgraded, it stops the service and disables it on
+	// removal
+	PackagePreRmTemplate = `#!/bin/sh
+set -e
+
+if [ -d /run/systemd/system ]; then
+    systemctl stop {{.Unit}} || true
+elif [ -x /etc/init.d/{{.Script}} ]; then
+    /etc/init.d/{{.Script}} stop || true
+fi
+
+if {{.Removing}}; then
+    if command -v systemctl >/dev/null 2>&1; then
+        systemctl disable {{.Unit}} || true
+    fi
+    if command -v update-rc.d >/dev/null 2>&1; then
+        update-rc.d -f {{.Script}} remove
+    elif command -v chkconfig >/dev/null 2>&1; then
+        chkconfig --del {{.Script}} || true
+    fi
+fi
+`
+
+	// PackagePostRmTemplate for the script deb and rpm packages run after
+	// they are removed, systemd forgets the removed unit
+	PackagePostRmTemplate = `#!/bin/sh
+set -e
+
+if [ -d /run/systemd/system ]; then
+    systemctl daemon-reload || true
+fi
 `
 )
@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// quotingArgs are arguments each backend has to pass through unchanged
+var quotingArgs = [][]string{
+	{"--port", "8080"},
+	{"two words", "tab\there", ""},
+	{`it's`, `say "hi"`, `back\slash`, "$HOME", "`id`", "50%", "a;b", "*", "é"},
+}
+
+func TestShellWords(t *testing.T) {
+	for _, args := range quotingArgs {
+		if got := splitShellWords(shellWords(args)); !reflect.DeepEqual(got, args) {
+			t.Errorf("splitShellWords(shellWords(%q)) = %q", args, got)
+		}
+
+		// The shell gets the same words, from a command line and from the
+		// DAEMON_ARGS the init scripts eval
+		printArgs := `for a in "$@"; do printf '<%s>\n' "$a"; done`
+		want := ""
+		for _, arg := range args {
+			want += "<" + arg + ">\n"
+		}
+		out, err := exec.Command("/bin/sh", "-c", "set -- "+shellWords(args)+"; "+printArgs).Output()
+		if err != nil || string(out) != want {
+			t.Errorf("sh got %q, %v for %q", out, err, args)
+		}
+		script := `DAEMON_ARGS="` + shellArgs(args) + `"` + "\n" + `eval "set -- $DAEMON_ARGS"; ` + printArgs
+		out, err = exec.Command("/bin/sh", "-c", script).Output()
+		if err != nil || string(out) != want {
+			t.Errorf("sh got %q, %v from DAEMON_ARGS for %q", out, err, args)
+		}
+
+		path := filepath.Join(t.TempDir(), "env")
+		if err := ioutil.WriteFile(path, []byte(`DAEMON_ARGS="`+shellArgs(args)+"\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := shellArgsFromFile(path, daemonArgsRe); !reflect.DeepEqual(got, args) {
+			t.Errorf("shellArgsFromFile = %q, want %q", got, args)
+		}
+	}
+}
+
+func TestSystemdWords(t *testing.T) {
+	for _, args := range quotingArgs {
+		line := systemdWords(args)
+		if got := splitSystemdWords(line); !reflect.DeepEqual(got, args) {
+			t.Errorf("splitSystemdWords(%q) = %q, want %q", line, got, args)
+		}
+		// A lone '%' or '$' would start a specifier or a variable
+		if regexp.MustCompile(`(^|[^%])%([^%]|$)`).MatchString(strings.Replace(line, "%%", "", -1)+" ") ||
+			strings.Contains(strings.Replace(line, "$$", "", -1), "$") {
+			t.Errorf("systemdWords(%q) = %q leaves a '%%' or '$' unescaped", args, line)
+		}
+	}
+
+	if got := splitSystemdWords(`--name "two words" "a\"b" 50%% $$HOME`); !reflect.DeepEqual(got, []string{"--name", "two words", `a"b`, "50%", "$HOME"}) {
+		t.Errorf("splitSystemdWords = %q", got)
+	}
+}
+
+func TestDescriptionQuoting(t *testing.T) {
+	const descrip = `Billing "API" $HOME ` + "`id`" + ` 50% back\slash`
+	conf := &Config{Name: "app", Description: descrip}
+	if _, _, _, err := serviceNames(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shell reads the description the init scripts assign back as it was
+	shell := []struct {
+		name string
+		data func() ([]byte, error)
+		re   *regexp.Regexp
+	}{
+		{"sysv", func() ([]byte, error) {
+			return (&systemVDaemon{"/usr/bin/app", "app", descrip, nil, conf}).renderFor(nil, false)
+		}, regexp.MustCompile(`(?m)^servname=(.*)$`)},
+		{"sysv-debian", func() ([]byte, error) {
+			return (&systemVDaemon{"/usr/bin/app", "app", descrip, nil, conf}).renderFor(nil, true)
+		}, regexp.MustCompile(`(?m)^servname=(.*)$`)},
+		{"openrc", func() ([]byte, error) {
+			return (&openrcDaemon{"/usr/bin/app", "app", descrip, nil, conf}).render(nil)
+		}, regexp.MustCompile(`(?m)^description=(.*)$`)},
+	}
+	for _, tt := range shell {
+		data, err := tt.data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := tt.re.FindSubmatch(data)
+		if m == nil {
+			t.Fatalf("%s: no description in\n%s", tt.name, data)
+		}
+		out, err := exec.Command("/bin/sh", "-c", "d="+string(m[1])+`; printf '%s' "$d"`).Output()
+		if err != nil || string(out) != descrip {
+			t.Errorf("%s: sh reads %q, %v, want %q", tt.name, out, err, descrip)
+		}
+	}
+
+	data, err := (&systemDaemon{"/usr/bin/app", "app", descrip, nil, conf}).render(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\nDescription=" + strings.Replace(descrip, "%", "%%", -1) + "\n"; !strings.Contains(string(data), want) {
+		t.Errorf("systemd unit has no %q:\n%s", want, data)
+	}
+	data, err = (&upstartDaemon{"/usr/bin/app", "app", descrip, nil, conf}).render(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `description     "Billing \"API\" $HOME ` + "`id`" + ` 50% back\\slash"`; !strings.Contains(string(data), want) {
+		t.Errorf("upstart job has no %q:\n%s", want, data)
+	}
+
+	for _, c := range []Config{{Description: "two\nlines"}, {DisplayName: "tab\there"}, {Description: "nul\x00"}} {
+		if _, _, _, err := serviceNames(&c); err != errDescrip {
+			t.Errorf("serviceNames(%q, %q) = %v, want %v", c.DisplayName, c.Description, err, errDescrip)
+		}
+	}
+}
@@ -3,12 +3,12 @@
 package daemon
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
-	"strings"
 	"text/template"
 )
 
@@ -16,24 +16,38 @@ type bsdDaemon struct {
 	exePath string
 	name    string
 	descrip string
+	conf    *Config
 }
 
-func newDaemon(exepath, appName, serverName string) (daemon, error) {
-	descrip := appName + " server daemon"
-	return &bsdDaemon{exepath, serverName, descrip}, nil
+func newDaemon(exepath, serverName string, conf *Config) (daemon, error) {
+	descrip := conf.Description
+	if conf.Instance != "" {
+		serverName += "_" + conf.Instance
+	}
+	// rc.d names end up in shell variables like <name>_enable
+	serverName = escapeName(serverName, func(r rune) bool {
+		return r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9'
+	})
+	return &bsdDaemon{exepath, serverName, descrip, conf}, nil
 }
 
 func (bsd *bsdDaemon) serviceScrpitPath() string {
-	return "/usr/local/etc/rc.d/" + bsd.name
+	return bsd.conf.path("/usr/local/etc/rc.d/" + bsd.name)
+}
+
+func (bsd *bsdDaemon) describe() *Status {
+	return &Status{Name: bsd.name, Backend: "rc.d", Path: bsd.serviceScrpitPath()}
 }
 
+var bsdArgsRe = regexp.MustCompile(`(?m)^start_cmd=".* -f \$command (.*)"$`)
+
 func (bsd *bsdDaemon) IsInstalled() bool {
 	_, err := os.Stat(bsd.serviceScrpitPath())
 	return err == nil
 }
 
 func (bsd *bsdDaemon) isEnabled() bool {
-	rcConf, err := os.Open("/etc/rc.conf")
+	rcConf, err := os.Open(bsd.conf.path("/etc/rc.conf"))
 	if err != nil {
 		return false
 	}
@@ -54,16 +68,21 @@ func (bsd *bsdDaemon) isEnabled() bool {
 	return chrFound
 }
 
+// getCmd returns the rc command cmd, or its "one" form for a service that
+// is not enabled. The status probes run quietly, the other commands note the
+// switch on stderr.
 func (bsd *bsdDaemon) getCmd(cmd string) string {
 	if !bsd.isEnabled() {
-		fmt.Println("Service is not enabled, using \"one" + cmd + "\" instead")
+		if cmd != "status" && !bsd.conf.Quiet && bsd.conf.Output != "json" {
+			fmt.Fprintln(os.Stderr, "Service is not enabled, using \"one"+cmd+"\" instead")
+		}
 		cmd = "one" + cmd
 	}
 	return cmd
 }
 
 func (bsd *bsdDaemon) isRunning() bool {
-	stdout, err := exec.Command("service", bsd.name, bsd.getCmd("status")).Output()
+	stdout, err := bsd.conf.output("service", bsd.name, bsd.getCmd("status"))
 	if err != nil {
 		return false
 	}
@@ -71,45 +90,79 @@ func (bsd *bsdDaemon) isRunning() bool {
 	return err == nil && matched
 }
 
-func (bsd *bsdDaemon) Install(args ...string) error {
-	if !checkRootGroup() {
+func (bsd *bsdDaemon) Install(args ...string) (err error) {
+	if !bsd.conf.privileged() {
 		return errPermit
 	}
 
-	if bsd.IsInstalled() {
-		return nil
+	path := bsd.serviceScrpitPath()
+	if keep, err := keepInstalled(bsd.conf, path); keep || err != nil {
+		return err
 	}
 
-	path := bsd.serviceScrpitPath()
-	file, err := os.Create(path)
+	data, err := bsd.render(args)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
+	j := &journal{conf: bsd.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = j.writeFile(path, withMarker(data), 0755); err != nil {
+		return err
+	}
+
+	// A reinstall leaves the service enabled or disabled as it is
+	if bsd.conf.reinstall {
+		return nil
+	}
+
+	if !bsd.conf.AutoStart {
+		return nil
+	}
+
+	return j.run([]string{"sysrc", bsd.name + "_enable=YES"}, []string{"sysrc", "-x", bsd.name + "_enable"})
+}
+
+// render returns the rc.d script Install writes for args
+func (bsd *bsdDaemon) render(args []string) ([]byte, error) {
 	templ, err := template.New("FreeBSDTemplate").Parse(FreeBSDTemplate)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var buf bytes.Buffer
 	if err := templ.Execute(
-		file,
+		&buf,
 		&struct {
-			Name, Description, Path, WorkDir, Args string
-		}{bsd.name, bsd.descrip, bsd.exePath, strings.TrimRight(bsd.exePath, bsd.name), strings.Join(args, " ")},
+			Name, Description, Path, WorkDir, Args, Instance, User string
+			Env                                                    []string
+			Limits                                                 Limits
+		}{bsd.name, bsd.descrip, bsd.exePath, filepath.Dir(bsd.exePath), shellArgs(args), bsd.conf.Instance,
+			bsd.conf.User, shellEnv(bsd.conf.envList()), bsd.conf.Limits},
 	); err != nil {
-		return err
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	if err := os.Chmod(path, 0755); err != nil {
-		return err
+func (bsd *bsdDaemon) isCurrent(args ...string) bool {
+	want, err := bsd.render(args)
+	if err != nil {
+		return false
 	}
-
-	return nil
+	return isRendered(bsd.serviceScrpitPath(), want)
 }
 
 func (bsd *bsdDaemon) UnInstall() error {
-	if !checkRootGroup() {
+	if !bsd.conf.privileged() {
 		return errPermit
 	}
 
@@ -117,17 +170,24 @@ func (bsd *bsdDaemon) UnInstall() error {
 		return nil
 	}
 
+	if err := checkOwner(bsd.conf, bsd.serviceScrpitPath()); err != nil {
+		return err
+	}
+
 	if bsd.isRunning() {
 		if err := bsd.Stop(); err != nil {
 			return err
 		}
 	}
 
-	return os.Remove(bsd.serviceScrpitPath())
+	// The variable is not set when the service was never enabled
+	bsd.conf.command("sysrc", "-x", bsd.name+"_enable")
+
+	return removeFiles(bsd.serviceScrpitPath(), bsd.conf.path("/var/run/"+bsd.name+".pid"))
 }
 
 func (bsd *bsdDaemon) Start() error {
-	if !checkRootGroup() {
+	if !bsd.conf.privileged() {
 		return errPermit
 	}
 
@@ -139,7 +199,7 @@ func (bsd *bsdDaemon) Start() error {
 		return nil
 	}
 
-	if err := exec.Command("service", bsd.name, bsd.getCmd("start")).Run(); err != nil {
+	if err := bsd.conf.command("service", bsd.name, bsd.getCmd("start")); err != nil {
 		return err
 	}
 
@@ -147,7 +207,7 @@ func (bsd *bsdDaemon) Start() error {
 }
 
 func (bsd *bsdDaemon) Stop() error {
-	if !checkRootGroup() {
+	if !bsd.conf.privileged() {
 		return errPermit
 	}
 
@@ -159,7 +219,7 @@ func (bsd *bsdDaemon) Stop() error {
 		return nil
 	}
 
-	if err := exec.Command("service", bsd.name, bsd.getCmd("stop")).Run(); err != nil {
+	if err := bsd.conf.command("service", bsd.name, bsd.getCmd("stop")); err != nil {
 		return err
 	}
 
@@ -167,7 +227,7 @@ func (bsd *bsdDaemon) Stop() error {
 }
 
 func (bsd *bsdDaemon) Restart() error {
-	if !checkRootGroup() {
+	if !bsd.conf.privileged() {
 		return errPermit
 	}
 
@@ -175,15 +235,33 @@ func (bsd *bsdDaemon) Restart() error {
 		return errNoInstall
 	}
 
-	if err := exec.Command("service", bsd.name, bsd.getCmd("restart")).Run(); err != nil {
+	if err := bsd.conf.command("service", bsd.name, bsd.getCmd("restart")); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (bsd *bsdDaemon) Status() error {
-	if !checkRootGroup() {
+func (bsd *bsdDaemon) Status() (*Status, error) {
+	if !bsd.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !bsd.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := bsd.describe()
+	st.Running, st.Enabled = bsd.isRunning(), bsd.isEnabled()
+	st.Args = shellArgsFromFile(bsd.serviceScrpitPath(), bsdArgsRe)
+	if st.Running {
+		st.PID = readPID(bsd.conf.path("/var/run/" + bsd.name + ".pid"))
+	}
+	return st.withState(), nil
+}
+
+func (bsd *bsdDaemon) Enable() error {
+	if !bsd.conf.privileged() {
 		return errPermit
 	}
 
@@ -191,13 +269,30 @@ func (bsd *bsdDaemon) Status() error {
 		return errNoInstall
 	}
 
-	if bsd.isRunning() {
-		return nil
+	return bsd.conf.command("sysrc", bsd.name+"_enable=YES")
+}
+
+func (bsd *bsdDaemon) Disable() error {
+	if !bsd.conf.privileged() {
+		return errPermit
 	}
 
-	return errStopped
+	if !bsd.IsInstalled() {
+		return errNoInstall
+	}
+
+	return bsd.conf.command("sysrc", bsd.name+"_enable=NO")
 }
 
 func (bsd *bsdDaemon) Run() error {
 	return nil
 }
+
+// listDaemons returns the rc.d scripts this package installed
+func listDaemons(conf *Config) ([]daemon, error) {
+	var ds []daemon
+	for name := range ownedFiles(conf.path("/usr/local/etc/rc.d"), "", "") {
+		ds = append(ds, &bsdDaemon{"", name, "", conf})
+	}
+	return ds, nil
+}
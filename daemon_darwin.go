@@ -1,9 +1,13 @@
 package daemon
 
 import (
+	"bytes"
+	"html"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"text/template"
 )
 
@@ -11,15 +15,71 @@ type darwinDaemon struct {
 	exePath string
 	name    string
 	descrip string
+	conf    *Config
 }
 
-func newDaemon(exepath, appName, serverName string) (daemon, error) {
-	descrip := appName + " server daemon"
-	return &darwinDaemon{exepath, serverName, descrip}, nil
+func newDaemon(exepath, serverName string, conf *Config) (daemon, error) {
+	descrip := conf.Description
+	serverName = escapeName(serverName, isNameChar)
+	if conf.Instance != "" {
+		serverName += "@" + conf.Instance
+	}
+	return &darwinDaemon{exepath, serverName, descrip, conf}, nil
 }
 
 func (darwin *darwinDaemon) servicePlistPath() string {
-	return "/Library/LaunchDaemons/com.nomadli." + darwin.name + ".plist"
+	return darwin.conf.path("/Library/LaunchDaemons/com.nomadli." + darwin.name + ".plist")
+}
+
+func (darwin *darwinDaemon) describe() *Status {
+	return &Status{Name: darwin.name, Backend: "launchd", Path: darwin.servicePlistPath()}
+}
+
+var darwinPIDRe = regexp.MustCompile(`"PID" = (\d+);`)
+
+func (darwin *darwinDaemon) pid() int {
+	stdout, err := darwin.conf.output("launchctl", "list", darwin.name)
+	if err != nil {
+		return 0
+	}
+	m := darwinPIDRe.FindSubmatch(stdout)
+	if m == nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(string(m[1]))
+	return pid
+}
+
+// args returns the ProgramArguments after the binary path
+func (darwin *darwinDaemon) args() []string {
+	data, err := ioutil.ReadFile(darwin.servicePlistPath())
+	if err != nil {
+		return nil
+	}
+	m := regexp.MustCompile(`(?s)<key>ProgramArguments</key>\s*<array>(.*?)</array>`).FindSubmatch(data)
+	if m == nil {
+		return nil
+	}
+	var args []string
+	for _, s := range regexp.MustCompile(`<string>(.*?)</string>`).FindAllSubmatch(m[1], -1) {
+		args = append(args, html.UnescapeString(string(s[1])))
+	}
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	return args
+}
+
+var runAtLoadRe = regexp.MustCompile(`(<key>RunAtLoad</key>\s*)<(true|false)/>`)
+
+// runAtLoad reports whether the installed plist starts the job at boot
+func (darwin *darwinDaemon) runAtLoad() bool {
+	data, err := ioutil.ReadFile(darwin.servicePlistPath())
+	if err != nil {
+		return false
+	}
+	m := runAtLoadRe.FindSubmatch(data)
+	return m != nil && string(m[2]) == "true"
 }
 
 func (darwin *darwinDaemon) IsInstalled() bool {
@@ -28,7 +88,7 @@ func (darwin *darwinDaemon) IsInstalled() bool {
 }
 
 func (darwin *darwinDaemon) isRunning() bool {
-	stdout, err := exec.Command("launchctl", "list", darwin.name).Output()
+	stdout, err := darwin.conf.output("launchctl", "list", darwin.name)
 	if err != nil {
 		return false
 	}
@@ -37,42 +97,102 @@ func (darwin *darwinDaemon) isRunning() bool {
 	return err == nil && matched
 }
 
-func (darwin *darwinDaemon) Install(args ...string) error {
-	if !checkRootGroup() {
+// launchd keeps the services that must not be loaded at boot in its disabled list
+func (darwin *darwinDaemon) isEnabled() bool {
+	stdout, err := darwin.conf.output("launchctl", "print-disabled", "system")
+	if err != nil {
+		return true
+	}
+
+	matched, err := regexp.MatchString(`"`+regexp.QuoteMeta(darwin.name)+`" => (true|disabled)`, string(stdout))
+	return err != nil || !matched
+}
+
+func (darwin *darwinDaemon) diagnose(lines int) (string, []string) {
+	var exitStatus string
+	if stdout, err := darwin.conf.output("launchctl", "list", darwin.name); err == nil {
+		if m := regexp.MustCompile(`"LastExitStatus" = (\d+);`).FindSubmatch(stdout); m != nil {
+			exitStatus = "LastExitStatus=" + string(m[1])
+		}
+	}
+	return exitStatus, tailFile(darwin.conf.path("/usr/local/var/log/"+darwin.name+".err"), lines)
+}
+
+func (darwin *darwinDaemon) Install(args ...string) (err error) {
+	if !darwin.conf.privileged() {
 		return errPermit
 	}
 
-	if darwin.IsInstalled() {
-		return nil
+	if keep, err := keepInstalled(darwin.conf, darwin.servicePlistPath()); keep || err != nil {
+		return err
 	}
 
-	path := darwin.servicePlistPath()
-	file, err := os.Create(path)
+	// A reinstall keeps the boot setting Enable and Disable made
+	autoStart := darwin.conf.AutoStart
+	if darwin.conf.reinstall && darwin.IsInstalled() {
+		autoStart = darwin.runAtLoad()
+	}
+	data, err := darwin.render(args, autoStart)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
+	j := &journal{conf: darwin.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if err = j.mkdirAll(filepath.Dir(darwin.servicePlistPath()), 0755); err != nil {
+		return err
+	}
+	if err = j.writeFile(darwin.servicePlistPath(), withMarker(data), 0644); err != nil {
+		return err
+	}
+
+	if darwin.conf.AutoStart || darwin.conf.reinstall {
+		return nil
+	}
+
+	return j.run([]string{"launchctl", "disable", "system/" + darwin.name}, []string{"launchctl", "enable", "system/" + darwin.name})
+}
+
+// render returns the plist Install writes for args, loaded at boot with
+// autoStart
+func (darwin *darwinDaemon) render(args []string, autoStart bool) ([]byte, error) {
 	templ, err := template.New("DarwinTemplate").Parse(DarwinTemplate)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var buf bytes.Buffer
 	if err := templ.Execute(
-		file,
+		&buf,
 		&struct {
-			Name, Path string
-			Args       []string
-		}{darwin.name, darwin.exePath, args},
+			Name, Path, Instance, User, Group string
+			Args                              []string
+			Env                               map[string]string
+			Limits                            Limits
+			AutoStart                         bool
+		}{darwin.name, darwin.exePath, darwin.conf.Instance, darwin.conf.User, darwin.conf.Group,
+			args, darwin.conf.Env, darwin.conf.Limits, autoStart},
 	); err != nil {
-		return err
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	return nil
+func (darwin *darwinDaemon) isCurrent(args ...string) bool {
+	want, err := darwin.render(args, darwin.runAtLoad())
+	if err != nil {
+		return false
+	}
+	return isRendered(darwin.servicePlistPath(), want)
 }
 
 func (darwin *darwinDaemon) UnInstall() error {
-	if !checkRootGroup() {
+	if !darwin.conf.privileged() {
 		return errPermit
 	}
 
@@ -80,17 +200,27 @@ func (darwin *darwinDaemon) UnInstall() error {
 		return nil
 	}
 
+	if err := checkOwner(darwin.conf, darwin.servicePlistPath()); err != nil {
+		return err
+	}
+
 	if darwin.isRunning() {
 		if err := darwin.Stop(); err != nil {
 			return err
 		}
 	}
 
-	return os.Remove(darwin.servicePlistPath())
+	if err := removeFiles(darwin.servicePlistPath()); err != nil {
+		return err
+	}
+	if !darwin.conf.Purge {
+		return nil
+	}
+	return removeFiles(darwin.conf.path("/usr/local/var/log/"+darwin.name+".log"), darwin.conf.path("/usr/local/var/log/"+darwin.name+".err"))
 }
 
 func (darwin *darwinDaemon) Start() error {
-	if !checkRootGroup() {
+	if !darwin.conf.privileged() {
 		return errPermit
 	}
 
@@ -102,11 +232,24 @@ func (darwin *darwinDaemon) Start() error {
 		return nil
 	}
 
-	return exec.Command("launchctl", "load", darwin.servicePlistPath()).Run()
+	if darwin.isEnabled() {
+		return darwin.conf.command("launchctl", "load", darwin.servicePlistPath())
+	}
+
+	// launchctl load refuses a disabled job, it is enabled for the load and
+	// disabled again so it still does not start at boot
+	if err := darwin.conf.command("launchctl", "enable", "system/"+darwin.name); err != nil {
+		return err
+	}
+	if err := darwin.conf.command("launchctl", "load", darwin.servicePlistPath()); err != nil {
+		darwin.conf.command("launchctl", "disable", "system/"+darwin.name)
+		return err
+	}
+	return darwin.conf.command("launchctl", "disable", "system/"+darwin.name)
 }
 
 func (darwin *darwinDaemon) Stop() error {
-	if !checkRootGroup() {
+	if !darwin.conf.privileged() {
 		return errPermit
 	}
 
@@ -118,11 +261,11 @@ func (darwin *darwinDaemon) Stop() error {
 		return nil
 	}
 
-	return exec.Command("launchctl", "unload", darwin.servicePlistPath()).Run()
+	return darwin.conf.command("launchctl", "unload", darwin.servicePlistPath())
 }
 
 func (darwin *darwinDaemon) Restart() error {
-	if !checkRootGroup() {
+	if !darwin.conf.privileged() {
 		return errPermit
 	}
 
@@ -130,11 +273,36 @@ func (darwin *darwinDaemon) Restart() error {
 		return errNoInstall
 	}
 
-	return exec.Command("launchctl", "reload", darwin.servicePlistPath()).Run()
+	return darwin.conf.command("launchctl", "reload", darwin.servicePlistPath())
 }
 
-func (darwin *darwinDaemon) Status() error {
-	if !checkRootGroup() {
+func (darwin *darwinDaemon) Status() (*Status, error) {
+	if !darwin.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !darwin.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := darwin.describe()
+	st.Running, st.Enabled = darwin.isRunning(), darwin.isEnabled()
+	st.PID, st.Args = darwin.pid(), darwin.args()
+	return st.withState(), nil
+}
+
+func (darwin *darwinDaemon) Enable() error {
+	return darwin.setBoot(true)
+}
+
+func (darwin *darwinDaemon) Disable() error {
+	return darwin.setBoot(false)
+}
+
+// setBoot sets RunAtLoad in the plist and the job in the disabled list of
+// launchd, so the job is loaded and started at boot or not at all
+func (darwin *darwinDaemon) setBoot(enable bool) (err error) {
+	if !darwin.conf.privileged() {
 		return errPermit
 	}
 
@@ -142,13 +310,41 @@ func (darwin *darwinDaemon) Status() error {
 		return errNoInstall
 	}
 
-	if darwin.isRunning() {
-		return nil
+	path := darwin.servicePlistPath()
+	if err := checkOwner(darwin.conf, path); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
 	}
 
-	return errStopped
+	j := &journal{conf: darwin.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	verb, undo, value := "enable", "disable", "${1}<true/>"
+	if !enable {
+		verb, undo, value = "disable", "enable", "${1}<false/>"
+	}
+	if err = j.writeFile(path, runAtLoadRe.ReplaceAll(data, []byte(value)), 0644); err != nil {
+		return err
+	}
+	return j.run([]string{"launchctl", verb, "system/" + darwin.name}, []string{"launchctl", undo, "system/" + darwin.name})
 }
 
 func (darwin *darwinDaemon) Run() error {
 	return nil
 }
+
+// listDaemons returns the launchd jobs this package installed
+func listDaemons(conf *Config) ([]daemon, error) {
+	var ds []daemon
+	for name := range ownedFiles(conf.path("/Library/LaunchDaemons"), "com.nomadli.", ".plist") {
+		ds = append(ds, &darwinDaemon{"", name, "", conf})
+	}
+	return ds, nil
+}
@@ -1,18 +1,103 @@
 package daemon
 
 import (
+	"io/ioutil"
 	"os"
+	"strings"
 )
 
-func newDaemon(exepath, appName, serverName string) (daemon, error) {
-	descrip := appName + " server daemon"
+func newDaemon(exepath, serverName string, conf *Config) (daemon, error) {
+	descrip := conf.Description
 	depends := []string{"network.target"}
 
-	if _, err := os.Stat("/run/systemd/system"); err == nil {
-		return &systemDaemon{exepath, serverName, descrip, depends}, nil
+	// A supervisor set up in Config.Runit, Config.S6 or Config.Supervisor
+	// takes the services on any host
+	supervisor := conf.Runit.ServiceDir != "" || conf.S6.ScanDir != "" || conf.Supervisor.ConfDir != ""
+	_, err := os.Stat(conf.path("/run/systemd/system"))
+	if !supervisor && (err == nil || conf.offline() && hasSystemd(conf)) {
+		return &systemDaemon{exepath, systemdEscape(serverName), descrip, depends, conf}, nil
 	}
-	if _, err := os.Stat("/sbin/initctl"); err == nil {
-		return &upstartDaemon{exepath, serverName, descrip, depends}, nil
+
+	serverName = escapeName(serverName, isNameChar)
+
+	// The other init systems have no template jobs, each instance is a job of
+	// its own
+	if conf.Instance != "" {
+		serverName += "@" + conf.Instance
+	}
+	switch {
+	case conf.S6.ScanDir != "":
+		return &s6Daemon{exepath, serverName, descrip, depends, conf}, nil
+	case conf.Runit.ServiceDir != "":
+		return &runitDaemon{exepath, serverName, descrip, depends, conf}, nil
+	case conf.Supervisor.ConfDir != "":
+		return &supervisorDaemon{exepath, serverName, descrip, depends, conf}, nil
+	case hasOpenRC(conf):
+		return &openrcDaemon{exepath, serverName, descrip, depends, conf}, nil
+	case hasS6(conf):
+		return &s6Daemon{exepath, serverName, descrip, depends, conf}, nil
+	case hasRunit(conf):
+		return &runitDaemon{exepath, serverName, descrip, depends, conf}, nil
+	case hasSupervisor(conf):
+		return &supervisorDaemon{exepath, serverName, descrip, depends, conf}, nil
+	}
+	if _, err := os.Stat(conf.path("/sbin/initctl")); err == nil {
+		return &upstartDaemon{exepath, serverName, descrip, depends, conf}, nil
+	}
+	return &systemVDaemon{exepath, serverName, descrip, depends, conf}, nil
+}
+
+// hasSystemd reports whether systemd is installed in the root, it is not
+// running there while an image is built
+func hasSystemd(conf *Config) bool {
+	for _, path := range []string{"/lib/systemd/systemd", "/usr/lib/systemd/systemd"} {
+		if _, err := os.Stat(conf.path(path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// listDaemons returns the systemd units, s6 and runit services, supervisord
+// programs, upstart jobs and SysV or OpenRC init scripts this package installed
+func listDaemons(conf *Config) ([]daemon, error) {
+	var ds []daemon
+	for name := range ownedFiles(conf.path("/etc/systemd/system"), "", ".service") {
+		if !strings.HasSuffix(name, "@") {
+			ds = append(ds, &systemDaemon{"", name, "", nil, conf})
+			continue
+		}
+
+		// A template unit runs the instances that have an environment file
+		name = strings.TrimSuffix(name, "@")
+		infos, _ := ioutil.ReadDir(conf.path("/etc/default"))
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), name+"@") {
+				c := *conf
+				c.Instance = strings.TrimPrefix(info.Name(), name+"@")
+				ds = append(ds, &systemDaemon{"", name, "", nil, &c})
+			}
+		}
+	}
+	for _, name := range s6Services(conf) {
+		ds = append(ds, &s6Daemon{"", name, "", nil, conf})
+	}
+	for _, name := range runitServices(conf) {
+		ds = append(ds, &runitDaemon{"", name, "", nil, conf})
+	}
+	dir, ext := supervisorConfDir(conf)
+	for name := range ownedFiles(conf.path(dir), "", ext) {
+		ds = append(ds, &supervisorDaemon{"", name, "", nil, conf})
+	}
+	for name := range ownedFiles(conf.path("/etc/init"), "", ".conf") {
+		ds = append(ds, &upstartDaemon{"", name, "", nil, conf})
+	}
+	for name := range ownedFiles(conf.path("/etc/init.d"), "", "") {
+		if hasOpenRC(conf) {
+			ds = append(ds, &openrcDaemon{"", name, "", nil, conf})
+			continue
+		}
+		ds = append(ds, &systemVDaemon{"", name, "", nil, conf})
 	}
-	return &systemVDaemon{exepath, serverName, descrip, depends}, nil
+	return ds, nil
 }
@@ -0,0 +1,296 @@
+package daemon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/template"
+)
+
+type openrcDaemon struct {
+	exePath  string
+	name     string
+	descrip  string
+	dependes []string
+	conf     *Config
+}
+
+// hasOpenRC reports whether OpenRC is the init system, as on Alpine and
+// Gentoo
+func hasOpenRC(conf *Config) bool {
+	for _, path := range []string{"/sbin/openrc-run", "/run/openrc"} {
+		if _, err := os.Stat(conf.path(path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (da *openrcDaemon) serviceScrpitPath() string {
+	return da.conf.path("/etc/init.d/" + da.name)
+}
+
+// runlevelLink is the link rc-update add makes to start the service in the
+// default runlevel
+func (da *openrcDaemon) runlevelLink() string {
+	return da.conf.path("/etc/runlevels/default/" + da.name)
+}
+
+func (da *openrcDaemon) describe() *Status {
+	return &Status{Name: da.name, Backend: "openrc", Path: da.serviceScrpitPath()}
+}
+
+var openrcArgsRe = regexp.MustCompile(`(?m)^command_args="(.*)"$`)
+
+func (da *openrcDaemon) IsInstalled() bool {
+	_, err := os.Stat(da.serviceScrpitPath())
+	return err == nil
+}
+
+// rc-service status exits with 0 only while the service is started
+func (da *openrcDaemon) isRunning() bool {
+	return da.conf.command("rc-service", da.name, "status") == nil
+}
+
+func (da *openrcDaemon) isEnabled() bool {
+	_, err := os.Lstat(da.runlevelLink())
+	return err == nil
+}
+
+// pid is the app supervise-daemon runs, the pidfile holds the supervisor
+func (da *openrcDaemon) pid() int {
+	return readPID(da.conf.path("/run/openrc/options/" + da.name + "/child_pid"))
+}
+
+// supervise-daemon keeps no record of how the app exited, only its log
+func (da *openrcDaemon) diagnose(lines int) (string, []string) {
+	return "", tailFile(da.conf.path("/var/log/"+da.name+"/"+da.name+".log"), lines)
+}
+
+func (da *openrcDaemon) Install(args ...string) (err error) {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	path := da.serviceScrpitPath()
+	if keep, err := keepInstalled(da.conf, path); keep || err != nil {
+		return err
+	}
+
+	data, err := da.render(args)
+	if err != nil {
+		return err
+	}
+
+	j := &journal{conf: da.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = j.writeFile(path, withMarker(data), 0755); err != nil {
+		return err
+	}
+
+	if err = writeLogRotate(j, da.conf, da.name); err != nil {
+		return err
+	}
+
+	// A reinstall leaves the service enabled or disabled as it is
+	if da.conf.reinstall {
+		return nil
+	}
+
+	if !da.conf.AutoStart {
+		return nil
+	}
+
+	return da.enable(j)
+}
+
+// enable adds the service to the default runlevel, offline by making the
+// link like rc-update
+func (da *openrcDaemon) enable(j *journal) error {
+	if !da.conf.offline() {
+		return j.run([]string{"rc-update", "add", da.name, "default"}, []string{"rc-update", "del", da.name, "default"})
+	}
+
+	link := da.runlevelLink()
+	if err := j.mkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	return j.symlink("/etc/init.d/"+da.name, link)
+}
+
+// disable removes the service from every runlevel
+func (da *openrcDaemon) disable() error {
+	if da.isEnabled() && !da.conf.offline() {
+		if err := da.conf.command("rc-update", "del", da.name, "default"); err != nil {
+			return err
+		}
+	}
+
+	// rc-update del misses the runlevels other than default
+	links, err := filepath.Glob(da.conf.path("/etc/runlevels/*/" + da.name))
+	if err != nil {
+		return err
+	}
+	return removeFiles(links...)
+}
+
+// render returns the init script Install writes for args
+func (da *openrcDaemon) render(args []string) ([]byte, error) {
+	templ, err := template.New("LinuxOpenRCTemplate").Parse(LinuxOpenRCTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := templ.Execute(
+		&buf,
+		&struct {
+			Name, Description, Path, WorkDir, Args, Instance, User, Group string
+			Env                                                           []string
+			Limits                                                        Limits
+		}{da.name, dquoteEscaper.Replace(da.descrip), da.exePath, filepath.Dir(da.exePath), shellArgs(args), da.conf.Instance,
+			da.conf.user(), da.conf.group(), shellEnv(da.conf.envList()), da.conf.Limits},
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (da *openrcDaemon) isCurrent(args ...string) bool {
+	want, err := da.render(args)
+	if err != nil {
+		return false
+	}
+	return isRendered(da.serviceScrpitPath(), want)
+}
+
+func (da *openrcDaemon) UnInstall() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil
+	}
+
+	if err := checkOwner(da.conf, da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
+	if da.isRunning() {
+		if err := da.Stop(); err != nil {
+			return err
+		}
+	}
+
+	if err := da.disable(); err != nil {
+		return err
+	}
+
+	if err := removeFiles(da.serviceScrpitPath(), da.conf.path("/run/"+da.name+".pid")); err != nil {
+		return err
+	}
+	return removeLogs(da.conf, da.name)
+}
+
+func (da *openrcDaemon) Start() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("rc-service", da.name, "start")
+}
+
+func (da *openrcDaemon) Stop() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if !da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("rc-service", da.name, "stop")
+}
+
+func (da *openrcDaemon) Restart() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	return da.conf.command("rc-service", da.name, "restart")
+}
+
+func (da *openrcDaemon) Status() (*Status, error) {
+	if !da.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := da.describe()
+	st.Running, st.Enabled = da.isRunning(), da.isEnabled()
+	st.Args = shellArgsFromFile(da.serviceScrpitPath(), openrcArgsRe)
+	if st.Running {
+		st.PID = da.pid()
+	}
+	return st.withState(), nil
+}
+
+func (da *openrcDaemon) Enable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if da.isEnabled() {
+		return nil
+	}
+	return da.enable(&journal{conf: da.conf})
+}
+
+func (da *openrcDaemon) Disable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	return da.disable()
+}
+
+func (da *openrcDaemon) Run() error {
+	return nil
+}
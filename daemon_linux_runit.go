@@ -0,0 +1,384 @@
+package daemon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type runitDaemon struct {
+	exePath  string
+	name     string
+	descrip  string
+	dependes []string
+	conf     *Config
+}
+
+// runsvdir looks for new services every five seconds
+const runsvdirScan = 6 * time.Second
+
+var runitPIDRe = regexp.MustCompile(`^run: [^:]*: \(pid (\d+)\)`)
+
+// hasRunit reports whether runit is the init system, as on Void Linux
+func hasRunit(conf *Config) bool {
+	for _, path := range []string{"/run/runit", "/etc/runit/runsvdir"} {
+		if _, err := os.Stat(conf.path(path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// runitDir is the directory holding the runit service directories
+func runitDir(conf *Config) string {
+	if conf.Runit.Dir != "" {
+		return conf.Runit.Dir
+	}
+	return "/etc/sv"
+}
+
+// runitServiceDir is the directory runsvdir supervises
+func runitServiceDir(conf *Config) string {
+	if conf.Runit.ServiceDir != "" {
+		return conf.Runit.ServiceDir
+	}
+	if _, err := os.Stat(conf.path("/var/service")); err == nil {
+		return "/var/service"
+	}
+	return "/etc/service"
+}
+
+// svDir is the service directory, as the running system sees it
+func (da *runitDaemon) svDir() string {
+	return runitDir(da.conf) + "/" + da.name
+}
+
+func (da *runitDaemon) serviceScrpitPath() string {
+	return da.conf.path(da.svDir() + "/run")
+}
+
+// downPath is the file that keeps runsv from starting the service, at boot
+// or when it is linked
+func (da *runitDaemon) downPath() string {
+	return da.conf.path(da.svDir() + "/down")
+}
+
+// serviceLink is the link that makes runsvdir supervise the service
+func (da *runitDaemon) serviceLink() string {
+	return da.conf.path(runitServiceDir(da.conf) + "/" + da.name)
+}
+
+func (da *runitDaemon) describe() *Status {
+	return &Status{Name: da.name, Backend: "runit", Path: da.serviceScrpitPath()}
+}
+
+func (da *runitDaemon) IsInstalled() bool {
+	_, err := os.Stat(da.serviceScrpitPath())
+	return err == nil
+}
+
+// status returns what sv status reports, it fails while no runsv supervises
+// the service
+func (da *runitDaemon) status() (string, error) {
+	out, err := da.conf.output("sv", "status", da.svDir())
+	return string(out), err
+}
+
+func (da *runitDaemon) isRunning() bool {
+	out, err := da.status()
+	return err == nil && strings.HasPrefix(out, "run: ")
+}
+
+// isEnabled reports whether runsv starts the service, the down file keeps
+// a linked service from starting
+func (da *runitDaemon) isEnabled() bool {
+	if _, err := os.Lstat(da.serviceLink()); err != nil {
+		return false
+	}
+	_, err := os.Stat(da.downPath())
+	return err != nil
+}
+
+func (da *runitDaemon) pid() int {
+	out, err := da.status()
+	if err != nil {
+		return 0
+	}
+	m := runitPIDRe.FindStringSubmatch(out)
+	if m == nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(m[1])
+	return pid
+}
+
+// svlogd writes the current log to the file current
+func (da *runitDaemon) diagnose(lines int) (string, []string) {
+	return "", tailFile(da.conf.path("/var/log/"+da.name+"/current"), lines)
+}
+
+// supervised waits for runsvdir to pick up a service linked a moment ago
+func (da *runitDaemon) supervised() error {
+	deadline := time.Now().Add(runsvdirScan)
+	for {
+		_, err := da.status()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (da *runitDaemon) Install(args ...string) (err error) {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	path := da.serviceScrpitPath()
+	if keep, err := keepInstalled(da.conf, path); keep || err != nil {
+		return err
+	}
+
+	data, err := da.render(LinuxRunitTemplate, args)
+	if err != nil {
+		return err
+	}
+
+	j := &journal{conf: da.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// runsv starts a linked service at once, unless it is down
+	if !da.conf.AutoStart && !da.conf.reinstall {
+		if err = j.writeFile(da.downPath(), nil, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err = j.writeFile(path, withMarker(data), 0755); err != nil {
+		return err
+	}
+
+	if !da.conf.Runit.NoLog {
+		logRun := da.conf.path(da.svDir() + "/log/run")
+		if data, err = da.render(LinuxRunitLogTemplate, nil); err != nil {
+			return err
+		}
+		if err = j.mkdirAll(filepath.Dir(logRun), 0755); err != nil {
+			return err
+		}
+		if err = j.writeFile(logRun, withMarker(data), 0755); err != nil {
+			return err
+		}
+	}
+
+	return da.link(j)
+}
+
+// link makes runsvdir supervise the service
+func (da *runitDaemon) link(j *journal) error {
+	link := da.serviceLink()
+	if err := j.mkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	return j.symlink(da.svDir(), link)
+}
+
+// render returns the run script of templ Install writes for args
+func (da *runitDaemon) render(templ string, args []string) ([]byte, error) {
+	t, err := template.New("LinuxRunitTemplate").Parse(templ)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(
+		&buf,
+		&struct {
+			Name, Path, WorkDir, Args, Instance, User, Group string
+			Env                                              []string
+			Limits                                           Limits
+		}{da.name, da.exePath, filepath.Dir(da.exePath), shellArgs(args), da.conf.Instance,
+			da.conf.user(), da.conf.group(), shellEnv(da.conf.envList()), da.conf.Limits},
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (da *runitDaemon) isCurrent(args ...string) bool {
+	want, err := da.render(LinuxRunitTemplate, args)
+	if err != nil {
+		return false
+	}
+	return isRendered(da.serviceScrpitPath(), want)
+}
+
+func (da *runitDaemon) UnInstall() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil
+	}
+
+	if err := checkOwner(da.conf, da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
+	if da.isRunning() {
+		if err := da.Stop(); err != nil {
+			return err
+		}
+	}
+
+	if err := removeFiles(da.serviceLink()); err != nil {
+		return err
+	}
+
+	// runsv would recreate the supervise directory until runsvdir notices
+	// the link is gone
+	if !da.conf.offline() {
+		da.conf.command("sv", "exit", da.svDir())
+	}
+
+	if err := removeFiles(da.conf.path(da.svDir())); err != nil {
+		return err
+	}
+	return removeLogs(da.conf, da.name)
+}
+
+func (da *runitDaemon) Start() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if err := da.supervised(); err != nil {
+		return err
+	}
+
+	if da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("sv", "up", da.svDir())
+}
+
+func (da *runitDaemon) Stop() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if !da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("sv", "down", da.svDir())
+}
+
+func (da *runitDaemon) Restart() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if err := da.supervised(); err != nil {
+		return err
+	}
+
+	return da.conf.command("sv", "restart", da.svDir())
+}
+
+func (da *runitDaemon) Status() (*Status, error) {
+	if !da.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := da.describe()
+	st.Running, st.Enabled = da.isRunning(), da.isEnabled()
+	st.Args = shellArgsFromFile(da.serviceScrpitPath(), daemonArgsRe)
+	if st.Running {
+		st.PID = da.pid()
+	}
+	return st.withState(), nil
+}
+
+// Enable links the service and lets runsv start it
+func (da *runitDaemon) Enable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if err := removeFiles(da.downPath()); err != nil {
+		return err
+	}
+	return da.link(&journal{conf: da.conf})
+}
+
+// Disable keeps the service supervised, so it can still be started, but
+// down at boot
+func (da *runitDaemon) Disable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	return writeFile(da.downPath(), nil, 0644)
+}
+
+func (da *runitDaemon) Run() error {
+	return nil
+}
+
+// runitServices returns the names of the runit services this package
+// installed
+func runitServices(conf *Config) []string {
+	dir := conf.path(runitDir(conf))
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() && isOwned(dir+"/"+info.Name()+"/run") {
+			names = append(names, info.Name())
+		}
+	}
+	return names
+}
@@ -0,0 +1,434 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type s6Daemon struct {
+	exePath  string
+	name     string
+	descrip  string
+	dependes []string
+	conf     *Config
+}
+
+// s6-supervise takes over a linked service right after the rescan
+const s6Scan = 2 * time.Second
+
+// hasS6 reports whether s6-svscan supervises the services, found by the
+// control directory it keeps in its scan directory
+func hasS6(conf *Config) bool {
+	for _, path := range []string{"/run/service/.s6-svscan", "/service/.s6-svscan", "/etc/s6-linux-init"} {
+		if _, err := os.Stat(conf.path(path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// s6Dir is the directory holding the s6 service directories
+func s6Dir(conf *Config) string {
+	if conf.S6.Dir != "" {
+		return conf.S6.Dir
+	}
+	return "/etc/s6/sv"
+}
+
+// s6ScanDir is the scan directory s6-svscan watches
+func s6ScanDir(conf *Config) string {
+	if conf.S6.ScanDir != "" {
+		return conf.S6.ScanDir
+	}
+	if _, err := os.Stat(conf.path("/run/service")); err == nil {
+		return "/run/service"
+	}
+	return "/service"
+}
+
+// svDir is the service directory, as the running system sees it
+func (da *s6Daemon) svDir() string {
+	return s6Dir(da.conf) + "/" + da.name
+}
+
+func (da *s6Daemon) serviceScrpitPath() string {
+	return da.conf.path(da.svDir() + "/run")
+}
+
+// downPath is the file that keeps s6-supervise from starting the service
+func (da *s6Daemon) downPath() string {
+	return da.conf.path(da.svDir() + "/down")
+}
+
+// serviceLink is the link that makes s6-svscan supervise the service
+func (da *s6Daemon) serviceLink() string {
+	return da.conf.path(s6ScanDir(da.conf) + "/" + da.name)
+}
+
+func (da *s6Daemon) describe() *Status {
+	return &Status{Name: da.name, Backend: "s6", Path: da.serviceScrpitPath()}
+}
+
+func (da *s6Daemon) IsInstalled() bool {
+	_, err := os.Stat(da.serviceScrpitPath())
+	return err == nil
+}
+
+// svstat returns the up, ready, pid, exitcode and signal fields of
+// s6-svstat, it fails while no s6-supervise runs the service
+func (da *s6Daemon) svstat() ([]string, error) {
+	out, err := da.conf.output("s6-svstat", "-o", "up,ready,pid,exitcode,signal", da.svDir())
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("unexpected s6-svstat output %q", out)
+	}
+	return fields, nil
+}
+
+// notifies reports whether the service tells s6 when it is ready
+func (da *s6Daemon) notifies() bool {
+	_, err := os.Stat(da.conf.path(da.svDir() + "/notification-fd"))
+	return err == nil
+}
+
+// isRunning reports whether the service is up, and ready when it notifies
+func (da *s6Daemon) isRunning() bool {
+	fields, err := da.svstat()
+	if err != nil {
+		return false
+	}
+	return fields[0] == "true" && (fields[1] == "true" || !da.notifies())
+}
+
+// isEnabled reports whether s6-supervise starts the service, the down file
+// keeps a linked service from starting
+func (da *s6Daemon) isEnabled() bool {
+	if _, err := os.Lstat(da.serviceLink()); err != nil {
+		return false
+	}
+	_, err := os.Stat(da.downPath())
+	return err != nil
+}
+
+func (da *s6Daemon) pid() int {
+	fields, err := da.svstat()
+	if err != nil || fields[0] != "true" {
+		return 0
+	}
+	pid, _ := strconv.Atoi(fields[2])
+	return pid
+}
+
+// s6-supervise keeps how the service last exited, s6-log writes the
+// current log to the file current
+func (da *s6Daemon) diagnose(lines int) (string, []string) {
+	var status string
+	if fields, err := da.svstat(); err == nil {
+		switch {
+		case fields[4] != "NA":
+			status = "killed by " + fields[4]
+		case fields[3] != "-1":
+			status = "exit status " + fields[3]
+		}
+	}
+	return status, tailFile(da.conf.path("/var/log/"+da.name+"/current"), lines)
+}
+
+// supervised makes s6-svscan pick up a service linked a moment ago and
+// waits for its s6-supervise
+func (da *s6Daemon) supervised() error {
+	if _, err := da.svstat(); err == nil {
+		return nil
+	}
+	if err := da.conf.command("s6-svscanctl", "-a", s6ScanDir(da.conf)); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(s6Scan)
+	for {
+		_, err := da.svstat()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func (da *s6Daemon) Install(args ...string) (err error) {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	path := da.serviceScrpitPath()
+	if keep, err := keepInstalled(da.conf, path); keep || err != nil {
+		return err
+	}
+
+	data, err := da.render(LinuxS6Template, args)
+	if err != nil {
+		return err
+	}
+
+	j := &journal{conf: da.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// s6-supervise starts a linked service at once, unless it is down
+	if !da.conf.AutoStart && !da.conf.reinstall {
+		if err = j.writeFile(da.downPath(), nil, 0644); err != nil {
+			return err
+		}
+	}
+
+	// type makes the directory an s6-rc source, notification-fd the fd
+	// Ready writes to, a reinstall without Notify drops it
+	files := map[string]string{"type": "longrun\n"}
+	if da.conf.Notify {
+		files["notification-fd"] = "3\n"
+	} else if err = j.remove(da.conf.path(da.svDir() + "/notification-fd")); err != nil {
+		return err
+	}
+	for name, content := range files {
+		if err = j.writeFile(da.conf.path(da.svDir()+"/"+name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	if err = j.writeFile(path, withMarker(data), 0755); err != nil {
+		return err
+	}
+
+	scripts := map[string]string{"finish": LinuxS6FinishTemplate}
+	if !da.conf.S6.NoLog {
+		scripts["log/run"] = LinuxS6LogTemplate
+	}
+	for name, templ := range scripts {
+		script := da.conf.path(da.svDir() + "/" + name)
+		if data, err = da.render(templ, nil); err != nil {
+			return err
+		}
+		if err = j.mkdirAll(filepath.Dir(script), 0755); err != nil {
+			return err
+		}
+		if err = j.writeFile(script, withMarker(data), 0755); err != nil {
+			return err
+		}
+	}
+
+	return da.link(j)
+}
+
+// link makes s6-svscan supervise the service
+func (da *s6Daemon) link(j *journal) error {
+	link := da.serviceLink()
+	if err := j.mkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	return j.symlink(da.svDir(), link)
+}
+
+// render returns the script of templ Install writes for args
+func (da *s6Daemon) render(templ string, args []string) ([]byte, error) {
+	t, err := template.New("LinuxS6Template").Parse(templ)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(
+		&buf,
+		&struct {
+			Name, Path, WorkDir, Args, Instance, User, Group string
+			Env                                              []string
+			Limits                                           Limits
+			Notify                                           bool
+		}{da.name, da.exePath, filepath.Dir(da.exePath), shellArgs(args), da.conf.Instance,
+			da.conf.user(), da.conf.group(), shellEnv(da.conf.envList()), da.conf.Limits, da.conf.Notify},
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (da *s6Daemon) isCurrent(args ...string) bool {
+	want, err := da.render(LinuxS6Template, args)
+	if err != nil {
+		return false
+	}
+	return isRendered(da.serviceScrpitPath(), want) && da.notifies() == da.conf.Notify
+}
+
+func (da *s6Daemon) UnInstall() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil
+	}
+
+	if err := checkOwner(da.conf, da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
+	if da.isRunning() {
+		if err := da.Stop(); err != nil {
+			return err
+		}
+	}
+
+	if err := removeFiles(da.serviceLink()); err != nil {
+		return err
+	}
+
+	// The rescan stops the s6-supervise of the unlinked service
+	if !da.conf.offline() {
+		da.conf.command("s6-svscanctl", "-an", s6ScanDir(da.conf))
+	}
+
+	if err := removeFiles(da.conf.path(da.svDir())); err != nil {
+		return err
+	}
+	return removeLogs(da.conf, da.name)
+}
+
+func (da *s6Daemon) Start() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if err := da.supervised(); err != nil {
+		return err
+	}
+
+	if da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("s6-svc", "-u", da.svDir())
+}
+
+func (da *s6Daemon) Stop() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if !da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("s6-svc", "-d", da.svDir())
+}
+
+func (da *s6Daemon) Restart() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if err := da.supervised(); err != nil {
+		return err
+	}
+
+	// -r only signals a service that is up
+	if !da.isRunning() {
+		return da.conf.command("s6-svc", "-u", da.svDir())
+	}
+	return da.conf.command("s6-svc", "-r", da.svDir())
+}
+
+func (da *s6Daemon) Status() (*Status, error) {
+	if !da.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := da.describe()
+	st.Running, st.Enabled = da.isRunning(), da.isEnabled()
+	st.Args = shellArgsFromFile(da.serviceScrpitPath(), daemonArgsRe)
+	if st.Running {
+		st.PID = da.pid()
+	}
+	return st.withState(), nil
+}
+
+// Enable links the service and lets s6-supervise start it
+func (da *s6Daemon) Enable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if err := removeFiles(da.downPath()); err != nil {
+		return err
+	}
+	return da.link(&journal{conf: da.conf})
+}
+
+// Disable keeps the service supervised, so it can still be started, but
+// down at boot
+func (da *s6Daemon) Disable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	return writeFile(da.downPath(), nil, 0644)
+}
+
+func (da *s6Daemon) Run() error {
+	return nil
+}
+
+// s6Services returns the names of the s6 services this package installed
+func s6Services(conf *Config) []string {
+	dir := conf.path(s6Dir(conf))
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() && isOwned(dir+"/"+info.Name()+"/run") {
+			names = append(names, info.Name())
+		}
+	}
+	return names
+}
@@ -0,0 +1,370 @@
+package daemon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+type supervisorDaemon struct {
+	exePath  string
+	name     string
+	descrip  string
+	dependes []string
+	conf     *Config
+}
+
+var (
+	supervisorArgsRe      = regexp.MustCompile(`(?m)^command=(.*)$`)
+	supervisorAutoStartRe = regexp.MustCompile(`(?m)^autostart=(true|false)$`)
+	supervisorPIDRe       = regexp.MustCompile(`\bpid (\d+),`)
+)
+
+// hasSupervisor reports whether supervisord is installed, by its config
+func hasSupervisor(conf *Config) bool {
+	for _, path := range []string{"/etc/supervisor/supervisord.conf", "/etc/supervisord.conf"} {
+		if _, err := os.Stat(conf.path(path)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// supervisorConfDir returns the directory supervisord includes programs
+// from and the extension it includes
+func supervisorConfDir(conf *Config) (string, string) {
+	dir := conf.Supervisor.ConfDir
+	if dir == "" {
+		dir = "/etc/supervisor/conf.d"
+		if _, err := os.Stat(conf.path("/etc/supervisor")); err != nil {
+			dir = "/etc/supervisord.d"
+		}
+	}
+	if filepath.Base(dir) == "supervisord.d" {
+		return dir, ".ini"
+	}
+	return dir, ".conf"
+}
+
+func (da *supervisorDaemon) serviceScrpitPath() string {
+	dir, ext := supervisorConfDir(da.conf)
+	return da.conf.path(dir + "/" + da.name + ext)
+}
+
+func (da *supervisorDaemon) describe() *Status {
+	return &Status{Name: da.name, Backend: "supervisord", Path: da.serviceScrpitPath()}
+}
+
+func (da *supervisorDaemon) IsInstalled() bool {
+	_, err := os.Stat(da.serviceScrpitPath())
+	return err == nil
+}
+
+// status returns the state supervisorctl reports and the rest of its line,
+// like "RUNNING" and "pid 4242, uptime 0:01:02"
+func (da *supervisorDaemon) status() (string, string) {
+	// supervisorctl status exits with 3 when the program is not running
+	out, _ := da.conf.output("supervisorctl", "status", da.name)
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 || fields[0] != da.name {
+		return "", ""
+	}
+	return fields[1], strings.Join(fields[2:], " ")
+}
+
+func (da *supervisorDaemon) isRunning() bool {
+	state, _ := da.status()
+	return state == "RUNNING"
+}
+
+// isEnabled reports whether supervisord starts the program when it starts
+func (da *supervisorDaemon) isEnabled() bool {
+	data, err := ioutil.ReadFile(da.serviceScrpitPath())
+	if err != nil {
+		return false
+	}
+	m := supervisorAutoStartRe.FindSubmatch(data)
+	return m != nil && string(m[1]) == "true"
+}
+
+func (da *supervisorDaemon) pid() int {
+	_, info := da.status()
+	m := supervisorPIDRe.FindStringSubmatch(info)
+	if m == nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(m[1])
+	return pid
+}
+
+// supervisorctl tells the state of a stopped program, like FATAL with
+// "Exited too quickly"
+func (da *supervisorDaemon) diagnose(lines int) (string, []string) {
+	state, info := da.status()
+	return strings.TrimSpace(state + " " + info), tailFile(da.conf.path("/var/log/"+da.name+"/"+da.name+".log"), lines)
+}
+
+// update makes supervisord read the program files and add, change or remove
+// the program
+func (da *supervisorDaemon) update() error {
+	if err := da.conf.command("supervisorctl", "reread"); err != nil {
+		return err
+	}
+	return da.conf.command("supervisorctl", "update", da.name)
+}
+
+func (da *supervisorDaemon) Install(args ...string) (err error) {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	path := da.serviceScrpitPath()
+	if keep, err := keepInstalled(da.conf, path); keep || err != nil {
+		return err
+	}
+
+	data, err := da.render(args)
+	if err != nil {
+		return err
+	}
+
+	j := &journal{conf: da.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	// supervisord does not create the log directory
+	if err = j.mkdirAll(da.conf.path("/var/log/"+da.name), 0755); err != nil {
+		return err
+	}
+
+	// supervisord drops a removed program on the update undone last
+	if !da.conf.offline() {
+		j.add(da.update)
+	}
+	if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = j.writeFile(path, withMarker(data), 0644); err != nil {
+		return err
+	}
+
+	if da.conf.offline() {
+		return nil
+	}
+
+	// update starts the program at once when it starts automatically
+	if err = j.run([]string{"supervisorctl", "reread"}, nil); err != nil {
+		return err
+	}
+	return j.run([]string{"supervisorctl", "update", da.name}, nil)
+}
+
+// args returns the arguments the program is installed with, the words of its
+// command after the program
+func (da *supervisorDaemon) args() []string {
+	command := strings.Replace(matchFile(da.serviceScrpitPath(), supervisorArgsRe), "%%", "%", -1)
+	words := splitShellWords(command)
+	if len(words) < 2 {
+		return nil
+	}
+	return words[1:]
+}
+
+// render returns the program file Install writes for args
+func (da *supervisorDaemon) render(args []string) ([]byte, error) {
+	templ, err := template.New("LinuxSupervisorTemplate").Parse(LinuxSupervisorTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	// supervisord expands %(name)s in values, env values are quoted
+	escape := strings.NewReplacer("%", "%%")
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%")
+	env := []string{serviceEnv + `="` + quote.Replace(da.name) + `"`}
+	if da.conf.Instance != "" {
+		env = append(env, instanceEnv+`="`+quote.Replace(da.conf.Instance)+`"`)
+	}
+	for _, e := range da.conf.envList() {
+		kv := strings.SplitN(e, "=", 2)
+		env = append(env, kv[0]+`="`+quote.Replace(kv[1])+`"`)
+	}
+
+	var buf bytes.Buffer
+	if err := templ.Execute(
+		&buf,
+		&struct {
+			Name, Command, WorkDir, User, Environment string
+			AutoStart                                 bool
+		}{da.name, escape.Replace(shellWords(append([]string{da.exePath}, args...))), filepath.Dir(da.exePath),
+			da.conf.User, strings.Join(env, ","), da.conf.AutoStart},
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (da *supervisorDaemon) isCurrent(args ...string) bool {
+	want, err := da.render(args)
+	if err != nil {
+		return false
+	}
+	// autostart is the enabled state apply converges on its own
+	want = supervisorAutoStartRe.ReplaceAll(want, []byte("autostart="+strconv.FormatBool(da.isEnabled())))
+	return isRendered(da.serviceScrpitPath(), want)
+}
+
+// setAutoStart rewrites the autostart setting of the program file, it takes
+// effect when supervisord starts
+func (da *supervisorDaemon) setAutoStart(on bool) error {
+	path := da.serviceScrpitPath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data = supervisorAutoStartRe.ReplaceAll(data, []byte("autostart="+strconv.FormatBool(on)))
+	return writeFile(path, data, 0644)
+}
+
+func (da *supervisorDaemon) UnInstall() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil
+	}
+
+	if err := checkOwner(da.conf, da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
+	if da.isRunning() {
+		if err := da.Stop(); err != nil {
+			return err
+		}
+	}
+
+	if err := removeFiles(da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
+	if !da.conf.offline() {
+		if err := da.update(); err != nil {
+			return err
+		}
+	}
+	return removeLogs(da.conf, da.name)
+}
+
+func (da *supervisorDaemon) Start() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	// update adds a program installed since supervisord last read the files
+	if state, _ := da.status(); state == "" {
+		if err := da.update(); err != nil {
+			return err
+		}
+	}
+
+	if da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("supervisorctl", "start", da.name)
+}
+
+func (da *supervisorDaemon) Stop() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if !da.isRunning() {
+		return nil
+	}
+
+	return da.conf.command("supervisorctl", "stop", da.name)
+}
+
+func (da *supervisorDaemon) Restart() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if state, _ := da.status(); state == "" {
+		if err := da.update(); err != nil {
+			return err
+		}
+	}
+
+	return da.conf.command("supervisorctl", "restart", da.name)
+}
+
+func (da *supervisorDaemon) Status() (*Status, error) {
+	if !da.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := da.describe()
+	st.Running, st.Enabled = da.isRunning(), da.isEnabled()
+	st.Args = da.args()
+	if st.Running {
+		st.PID = da.pid()
+	}
+	return st.withState(), nil
+}
+
+// Enable makes supervisord start the program when it starts, a running
+// program is left alone
+func (da *supervisorDaemon) Enable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	return da.setAutoStart(true)
+}
+
+func (da *supervisorDaemon) Disable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	return da.setAutoStart(false)
+}
+
+func (da *supervisorDaemon) Run() error {
+	return nil
+}
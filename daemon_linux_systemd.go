@@ -1,9 +1,13 @@
 package daemon
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -13,19 +17,85 @@ type systemDaemon struct {
 	name     string
 	descrip  string
 	dependes []string
+	conf     *Config
 }
 
+// systemdEscape escapes the characters a unit name may not contain as \xNN,
+// like systemd-escape does. '@' is escaped too, it separates the instance.
+func systemdEscape(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == ':' || c == '_' || c == '-' || c == '.' && i > 0 ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "\\x%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// unitName is the unit systemctl acts on, <name>@<instance> for an instance
+func (da *systemDaemon) unitName() string {
+	if da.conf.Instance != "" {
+		return da.name + "@" + da.conf.Instance
+	}
+	return da.name
+}
+
+// serviceScrpitPath is the <name>@.service template unit for an instance
 func (da *systemDaemon) serviceScrpitPath() string {
-	return "/etc/systemd/system/" + da.name + ".service"
+	if da.conf.Instance != "" {
+		return da.conf.path("/etc/systemd/system/" + da.name + "@.service")
+	}
+	return da.conf.path("/etc/systemd/system/" + da.name + ".service")
+}
+
+// instanceEnvPath holds the arguments of one instance, see LinuxSystemDTemplate
+func (da *systemDaemon) instanceEnvPath() string {
+	return da.conf.path("/etc/default/" + da.name + "@" + da.conf.Instance)
+}
+
+func (da *systemDaemon) describe() *Status {
+	return &Status{Name: da.unitName(), Backend: "systemd", Path: da.serviceScrpitPath()}
+}
+
+var (
+	execStartRe  = regexp.MustCompile(`(?m)^ExecStart=\S+ *(.*)$`)
+	daemonArgsRe = regexp.MustCompile(`(?m)^DAEMON_ARGS="(.*)"$`)
+)
+
+// args returns the arguments the service is installed with
+func (da *systemDaemon) args() []string {
+	if da.conf.Instance != "" {
+		return shellArgsFromFile(da.instanceEnvPath(), daemonArgsRe)
+	}
+	return splitSystemdWords(matchFile(da.serviceScrpitPath(), execStartRe))
+}
+
+func (da *systemDaemon) pid() int {
+	stdout, err := da.conf.output("systemctl", "show", "-p", "MainPID", da.unitName())
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(string(stdout)), "MainPID="))
+	return pid
 }
 
 func (da *systemDaemon) IsInstalled() bool {
-	_, err := os.Stat(da.serviceScrpitPath())
+	if _, err := os.Stat(da.serviceScrpitPath()); err != nil {
+		return false
+	}
+	if da.conf.Instance == "" {
+		return true
+	}
+	_, err := os.Stat(da.instanceEnvPath())
 	return err == nil
 }
 
 func (da *systemDaemon) isRunning() bool {
-	stdout, err := exec.Command("systemctl", "status", da.name).Output()
+	stdout, err := da.conf.output("systemctl", "status", da.unitName())
 	if err != nil {
 		return false
 	}
@@ -34,45 +104,218 @@ func (da *systemDaemon) isRunning() bool {
 	return err == nil && matched
 }
 
-func (da *systemDaemon) Install(args ...string) error {
-	if !checkRootGroup() {
-		return errPermit
+func (da *systemDaemon) isEnabled() bool {
+	if da.conf.offline() {
+		_, err := os.Lstat(da.wantsLink())
+		return err == nil
 	}
+	return da.conf.command("systemctl", "is-enabled", "--quiet", da.unitName()) == nil
+}
 
-	if da.IsInstalled() {
-		return nil
+func (da *systemDaemon) diagnose(lines int) (string, []string) {
+	var exitStatus string
+	if stdout, err := da.conf.output("systemctl", "show", "-p", "Result", "-p", "ExecMainStatus", da.unitName()); err == nil {
+		exitStatus = strings.Join(strings.Fields(string(stdout)), " ")
+	}
+
+	stdout, err := da.conf.output("journalctl", "-u", da.unitName(), "-n", strconv.Itoa(lines), "--no-pager", "-o", "cat")
+	if err != nil || len(stdout) == 0 {
+		return exitStatus, nil
+	}
+	return exitStatus, strings.Split(strings.TrimRight(string(stdout), "\n"), "\n")
+}
+
+func (da *systemDaemon) Install(args ...string) (err error) {
+	if !da.conf.privileged() {
+		return errPermit
 	}
 
 	path := da.serviceScrpitPath()
-	file, err := os.Create(path)
+	keep, err := keepInstalled(da.conf, path)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	if keep && da.IsInstalled() {
+		return nil
+	}
+	if !keep {
+		if err := da.checkVendorUnit(); err != nil {
+			return err
+		}
+	}
+
+	j := &journal{conf: da.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if da.conf.Instance != "" {
+		if err = j.mkdirAll(da.conf.path("/etc/default"), 0755); err != nil {
+			return err
+		}
+		if err = j.writeFile(da.instanceEnvPath(), da.instanceEnv(args), 0644); err != nil {
+			return err
+		}
+		args = nil
+	}
+
+	if !keep {
+		var data []byte
+		if data, err = da.render(args); err != nil {
+			return err
+		}
+
+		// systemd forgets a removed unit on the reload undone last
+		if !da.conf.offline() {
+			j.add(func() error {
+				return da.conf.command("systemctl", "daemon-reload")
+			})
+		}
+		if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err = j.writeFile(path, withMarker(data), 0644); err != nil {
+			return err
+		}
+
+		if !da.conf.offline() {
+			if err = j.run([]string{"systemctl", "daemon-reload"}, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	// A reinstall leaves the service enabled or disabled as it is
+	if da.conf.reinstall {
+		return nil
+	}
+
+	if !da.conf.AutoStart {
+		return nil
+	}
+
+	return da.enable(j)
+}
+
+// wantsLink is the link systemctl enable makes for the unit, from the
+// WantedBy target of LinuxSystemDTemplate
+func (da *systemDaemon) wantsLink() string {
+	return da.conf.path("/etc/systemd/system/multi-user.target.wants/" + da.unitName() + ".service")
+}
+
+// enable enables the unit, offline by making the link like systemctl --root
+func (da *systemDaemon) enable(j *journal) error {
+	if !da.conf.offline() {
+		return j.run([]string{"systemctl", "enable", da.unitName()}, []string{"systemctl", "disable", da.unitName()})
+	}
+
+	link := da.wantsLink()
+	if err := j.mkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	return j.symlink("/etc/systemd/system/"+filepath.Base(da.serviceScrpitPath()), link)
+}
 
+// disable disables the unit, offline by removing the links to it
+func (da *systemDaemon) disable() error {
+	if da.conf.offline() {
+		return da.removeWants()
+	}
+	return da.conf.command("systemctl", "disable", da.unitName())
+}
+
+// checkVendorUnit fails when a package of the system ships a unit of the same
+// name, a unit in /etc/systemd/system would override it
+func (da *systemDaemon) checkVendorUnit() error {
+	if da.conf.Force {
+		return nil
+	}
+	for _, dir := range []string{"/lib/systemd/system/", "/usr/lib/systemd/system/"} {
+		path := da.conf.path(dir + filepath.Base(da.serviceScrpitPath()))
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s: %w", path, errNotOwned)
+		}
+	}
+	return nil
+}
+
+// render returns the unit file Install writes for args
+func (da *systemDaemon) render(args []string) ([]byte, error) {
+	return da.renderFor(args, "")
+}
+
+// renderFor returns the unit file for args, reading its environment from
+// envFile too when it is set
+func (da *systemDaemon) renderFor(args []string, envFile string) ([]byte, error) {
 	templ, err := template.New("LinuxSystemDTemplate").Parse(LinuxSystemDTemplate)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Environment= takes C style quoting, and in Environment= and Description=
+	// '%' starts a specifier
+	env := da.conf.envList()
+	for i, e := range env {
+		env[i] = strings.Replace(strconv.Quote(e), "%", "%%", -1)
 	}
 
+	var buf bytes.Buffer
 	if err := templ.Execute(
-		file,
+		&buf,
 		&struct {
-			Description, Dependencies, WorkDir, Name, Path, Args string
-		}{da.descrip, strings.Join(da.dependes, " "), strings.TrimRight(da.exePath, da.name), da.name, da.exePath, strings.Join(args, " ")},
+			Description, Dependencies, WorkDir, Name, Path, Args, User, Group, EnvFile string
+			Env                                                                        []string
+			Limits                                                                     Limits
+			Hardening                                                                  Hardening
+			Template, Notify                                                           bool
+		}{strings.Replace(da.descrip, "%", "%%", -1), strings.Join(da.dependes, " "), filepath.Dir(da.exePath), da.name, da.exePath, systemdWords(args),
+			da.conf.user(), da.conf.group(), envFile, env, da.conf.Limits, da.conf.Hardening, da.conf.Instance != "", da.conf.Notify},
 	); err != nil {
-		return err
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
-		return err
+// instanceEnv returns the environment file of an instance, DAEMON_ARGS holds
+// its arguments quoted for the shell the template unit starts it with
+func (da *systemDaemon) instanceEnv(args []string) []byte {
+	return []byte("DAEMON_ARGS=\"" + shellArgs(args) + "\"\n")
+}
+
+func (da *systemDaemon) isCurrent(args ...string) bool {
+	if da.conf.Instance != "" {
+		data, err := ioutil.ReadFile(da.instanceEnvPath())
+		if err != nil || !bytes.Equal(data, da.instanceEnv(args)) {
+			return false
+		}
+		args = nil
 	}
 
-	return exec.Command("systemctl", "enable", da.name).Run()
+	want, err := da.render(args)
+	if err != nil {
+		return false
+	}
+	return isRendered(da.serviceScrpitPath(), want)
+}
+
+// hasInstances reports whether any instance still uses the template unit
+func (da *systemDaemon) hasInstances() bool {
+	infos, err := ioutil.ReadDir(da.conf.path("/etc/default"))
+	if err != nil {
+		return false
+	}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), da.name+"@") {
+			return true
+		}
+	}
+	return false
 }
 
 func (da *systemDaemon) UnInstall() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -80,21 +323,66 @@ func (da *systemDaemon) UnInstall() error {
 		return nil
 	}
 
+	if err := checkOwner(da.conf, da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
 	if da.isRunning() {
 		if err := da.Stop(); err != nil {
 			return err
 		}
 	}
 
-	if err := exec.Command("systemctl", "disable", da.name).Run(); err != nil {
+	if err := da.disable(); err != nil {
+		return err
+	}
+	// disable misses links made by hand or by an older unit
+	if err := da.removeWants(); err != nil {
 		return err
 	}
 
-	return os.Remove(da.serviceScrpitPath())
+	pidfile := da.conf.path("/var/run/" + da.unitName() + ".pid")
+	if da.conf.Instance != "" {
+		if err := removeFiles(da.instanceEnvPath(), pidfile); err != nil {
+			return err
+		}
+		if da.hasInstances() {
+			da.conf.command("systemctl", "reset-failed", da.unitName())
+			return nil
+		}
+	}
+
+	if err := removeFiles(da.serviceScrpitPath(), pidfile); err != nil {
+		return err
+	}
+	if da.conf.offline() {
+		return nil
+	}
+	if err := da.conf.command("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	// A unit that failed stays listed until its state is reset
+	da.conf.command("systemctl", "reset-failed", da.unitName())
+	return nil
+}
+
+// removeWants removes the links to the unit in the .wants directories
+func (da *systemDaemon) removeWants() error {
+	unit := da.unitName() + ".service"
+	dirs, err := filepath.Glob(da.conf.path("/etc/systemd/system/*.wants"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := removeFiles(filepath.Join(dir, unit)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (da *systemDaemon) Start() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -106,11 +394,11 @@ func (da *systemDaemon) Start() error {
 		return nil
 	}
 
-	return exec.Command("systemctl", "start", da.name).Run()
+	return da.conf.command("systemctl", "start", da.unitName())
 }
 
 func (da *systemDaemon) Stop() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -122,11 +410,11 @@ func (da *systemDaemon) Stop() error {
 		return nil
 	}
 
-	return exec.Command("systemctl", "stop", da.name).Run()
+	return da.conf.command("systemctl", "stop", da.unitName())
 }
 
 func (da *systemDaemon) Restart() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -134,11 +422,26 @@ func (da *systemDaemon) Restart() error {
 		return errNoInstall
 	}
 
-	return exec.Command("systemctl", "restart", da.name).Run()
+	return da.conf.command("systemctl", "restart", da.unitName())
+}
+
+func (da *systemDaemon) Status() (*Status, error) {
+	if !da.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := da.describe()
+	st.Running, st.Enabled = da.isRunning(), da.isEnabled()
+	st.PID, st.Args = da.pid(), da.args()
+	return st.withState(), nil
 }
 
-func (da *systemDaemon) Status() error {
-	if !checkRootGroup() {
+func (da *systemDaemon) Enable() error {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -146,11 +449,19 @@ func (da *systemDaemon) Status() error {
 		return errNoInstall
 	}
 
-	if da.isRunning() {
-		return nil
+	return da.enable(&journal{conf: da.conf})
+}
+
+func (da *systemDaemon) Disable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
 	}
 
-	return errStopped
+	return da.disable()
 }
 
 func (da *systemDaemon) Run() error {
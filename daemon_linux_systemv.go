@@ -1,10 +1,11 @@
 package daemon
 
 import (
+	"bytes"
+	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
-	"strings"
 	"text/template"
 )
 
@@ -13,10 +14,26 @@ type systemVDaemon struct {
 	name     string
 	descrip  string
 	dependes []string
+	conf     *Config
 }
 
 func (da *systemVDaemon) serviceScrpitPath() string {
-	return "/etc/init.d/" + da.name
+	return da.conf.path("/etc/init.d/" + da.name)
+}
+
+func (da *systemVDaemon) describe() *Status {
+	return &Status{Name: da.name, Backend: "sysv", Path: da.serviceScrpitPath()}
+}
+
+// debian reports whether update-rc.d manages the runlevel links, as on
+// Debian and Ubuntu, instead of chkconfig as on Red Hat
+func (da *systemVDaemon) debian() bool {
+	for _, path := range []string{"/usr/sbin/update-rc.d", "/sbin/update-rc.d"} {
+		if _, err := os.Stat(da.conf.path(path)); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
 func (da *systemVDaemon) IsInstalled() bool {
@@ -25,7 +42,7 @@ func (da *systemVDaemon) IsInstalled() bool {
 }
 
 func (da *systemVDaemon) isRunning() bool {
-	stdout, err := exec.Command("service", da.name, "status").Output()
+	stdout, err := da.conf.output("service", da.name, "status")
 	if err != nil {
 		return false
 	}
@@ -33,74 +50,218 @@ func (da *systemVDaemon) isRunning() bool {
 	return err == nil && matched
 }
 
-func (da *systemVDaemon) Install(args ...string) error {
-	if !checkRootGroup() {
-		return errPermit
+// isEnabled looks for the start links update-rc.d makes, their priority
+// depends on the LSB headers of the other scripts
+func (da *systemVDaemon) isEnabled() bool {
+	if da.conf.offline() || da.debian() {
+		links, _ := filepath.Glob(da.conf.path("/etc/rc[2-5].d/S[0-9][0-9]" + da.name))
+		return len(links) > 0
 	}
+	return da.conf.command("chkconfig", da.name) == nil
+}
 
-	if da.IsInstalled() {
-		return nil
+// The init script has no record of how the app exited, only its log
+func (da *systemVDaemon) diagnose(lines int) (string, []string) {
+	return "", tailFile(da.conf.path("/var/log/"+da.name+"/"+da.name+".log"), lines)
+}
+
+func (da *systemVDaemon) Install(args ...string) (err error) {
+	if !da.conf.privileged() {
+		return errPermit
 	}
 
 	path := da.serviceScrpitPath()
-	file, err := os.Create(path)
-	if err != nil {
+	if keep, err := keepInstalled(da.conf, path); keep || err != nil {
 		return err
 	}
-	defer file.Close()
 
-	templ, err := template.New("LinuxSystemVTemplate").Parse(LinuxSystemVTemplate)
+	data, err := da.render(args)
 	if err != nil {
 		return err
 	}
 
-	if err := templ.Execute(
-		file,
-		&struct {
-			Name, Path, Description, WorkDir, Args string
-		}{da.name, da.exePath, da.descrip, strings.TrimRight(da.exePath, da.name), strings.Join(args, " ")},
-	); err != nil {
+	j := &journal{conf: da.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err = j.writeFile(path, withMarker(data), 0755); err != nil {
+		return err
+	}
+
+	if err = writeLogRotate(j, da.conf, da.name); err != nil {
+		return err
+	}
+
+	// A reinstall leaves the service enabled or disabled as it is
+	if da.conf.reinstall {
+		return nil
+	}
+
+	if da.conf.offline() {
+		return da.link(j, da.conf.AutoStart)
+	}
+
+	if da.debian() {
+		if err = j.run([]string{"update-rc.d", da.name, "defaults"}, []string{"update-rc.d", "-f", da.name, "remove"}); err != nil {
+			return err
+		}
+		if da.conf.AutoStart {
+			return nil
+		}
+		return j.run([]string{"update-rc.d", da.name, "disable"}, nil)
+	}
+
+	if err = j.run([]string{"chkconfig", "--add", da.name}, []string{"chkconfig", "--del", da.name}); err != nil {
 		return err
 	}
 
-	if err := os.Chmod(path, 0755); err != nil {
+	if da.conf.AutoStart {
+		return nil
+	}
+
+	return j.run([]string{"chkconfig", da.name, "off"}, nil)
+}
+
+// rcLink is the link in the directory of runlevel that starts or stops the
+// script, with the priorities of the chkconfig line of LinuxSystemVTemplate
+func (da *systemVDaemon) rcLink(runlevel int, start bool) string {
+	if start {
+		return da.conf.path(fmt.Sprintf("/etc/rc%d.d/S98%s", runlevel, da.name))
+	}
+	return da.conf.path(fmt.Sprintf("/etc/rc%d.d/K17%s", runlevel, da.name))
+}
+
+// link makes the runlevel links chkconfig makes, starting the script in
+// runlevels 2 to 5 when on and stopping it in the others
+func (da *systemVDaemon) link(j *journal, on bool) error {
+	if err := da.unlink(); err != nil {
 		return err
 	}
+	for runlevel := 0; runlevel <= 6; runlevel++ {
+		link := da.rcLink(runlevel, on && runlevel >= 2 && runlevel <= 5)
+		if err := j.mkdirAll(filepath.Dir(link), 0755); err != nil {
+			return err
+		}
+		if err := j.symlink("../init.d/"+da.name, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Create logratate conf
-	path = "/etc/logrotate.d/" + da.name
-	logfile, err := os.Create(path)
+// unlink removes the runlevel links to the script
+func (da *systemVDaemon) unlink() error {
+	links, err := filepath.Glob(da.conf.path("/etc/rc[0-6].d/[SK][0-9][0-9]" + da.name))
 	if err != nil {
 		return err
 	}
-	defer logfile.Close()
+	return removeFiles(links...)
+}
 
-	if err = os.MkdirAll("/var/log/"+da.name, 0644); err != nil {
+// writeLogRotate writes the logrotate conf of the log SysV and OpenRC
+// services write to
+func writeLogRotate(j *journal, conf *Config, name string) error {
+	path := conf.path("/etc/logrotate.d/" + name)
+	if err := checkOwner(conf, path); err != nil {
 		return err
 	}
 
-	templ, err = template.New("LinuxLogRotateTemplate").Parse(LinuxLogRotateTemplate)
+	if err := j.mkdirAll(conf.path("/var/log/"+name), 0755); err != nil {
+		return err
+	}
+	if err := j.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	data, err := renderLogRotate(name)
 	if err != nil {
 		return err
 	}
 
+	return j.writeFile(path, withMarker(data), 0644)
+}
+
+// renderLogRotate returns the logrotate conf of the log of name
+func renderLogRotate(name string) ([]byte, error) {
+	templ, err := template.New("LinuxLogRotateTemplate").Parse(LinuxLogRotateTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
 	if err = templ.Execute(
-		logfile,
+		&buf,
 		&struct {
 			Name string
-		}{da.name},
+		}{name},
 	); err != nil {
-		return err
+		return nil, err
 	}
-	if err = os.Chmod(path, 0755); err != nil {
-		return err
+	return buf.Bytes(), nil
+}
+
+// removeLogs removes the logrotate conf writeLogRotate wrote, and the log
+// directory with conf.Purge
+func removeLogs(conf *Config, name string) error {
+	path := conf.path("/etc/logrotate.d/" + name)
+	if isOwned(path) || conf.Force {
+		if err := removeFiles(path); err != nil {
+			return err
+		}
+	}
+	if !conf.Purge {
+		return nil
+	}
+	return removeFiles(conf.path("/var/log/" + name))
+}
+
+// render returns the init script Install writes for args
+func (da *systemVDaemon) render(args []string) ([]byte, error) {
+	return da.renderFor(args, da.debian())
+}
+
+// renderFor returns the Debian or the Red Hat init script for args
+func (da *systemVDaemon) renderFor(args []string, debian bool) ([]byte, error) {
+	text := LinuxSystemVTemplate
+	if debian {
+		text = LinuxSystemVDebianTemplate
+	}
+	templ, err := template.New("LinuxSystemVTemplate").Parse(text)
+	if err != nil {
+		return nil, err
 	}
 
-	return exec.Command("chkconfig", "--add", da.name).Run()
+	var buf bytes.Buffer
+	if err := templ.Execute(
+		&buf,
+		&struct {
+			Name, Path, Description, WorkDir, Args, Instance, User, Group string
+			Env                                                           []string
+			Limits                                                        Limits
+		}{da.name, da.exePath, dquoteEscaper.Replace(da.descrip), filepath.Dir(da.exePath), shellArgs(args), da.conf.Instance,
+			da.conf.user(), da.conf.group(), shellEnv(da.conf.envList()), da.conf.Limits},
+	); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (da *systemVDaemon) isCurrent(args ...string) bool {
+	want, err := da.render(args)
+	if err != nil {
+		return false
+	}
+	return isRendered(da.serviceScrpitPath(), want)
 }
 
 func (da *systemVDaemon) UnInstall() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -108,21 +269,40 @@ func (da *systemVDaemon) UnInstall() error {
 		return nil
 	}
 
+	if err := checkOwner(da.conf, da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
 	if da.isRunning() {
 		if err := da.Stop(); err != nil {
 			return err
 		}
 	}
 
-	if err := exec.Command("chkconfig", "--del", da.name).Run(); err != nil {
-		return err
+	// chkconfig --del and update-rc.d remove take the rc.d links
+	switch {
+	case da.conf.offline():
+		if err := da.unlink(); err != nil {
+			return err
+		}
+	case da.debian():
+		if err := da.conf.command("update-rc.d", "-f", da.name, "remove"); err != nil {
+			return err
+		}
+	default:
+		if err := da.conf.command("chkconfig", "--del", da.name); err != nil {
+			return err
+		}
 	}
 
-	return os.Remove(da.serviceScrpitPath())
+	if err := removeFiles(da.serviceScrpitPath(), da.conf.path("/var/run/"+da.name+".pid"), da.conf.path("/var/lock/subsys/"+da.name)); err != nil {
+		return err
+	}
+	return removeLogs(da.conf, da.name)
 }
 
 func (da *systemVDaemon) Start() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -134,11 +314,11 @@ func (da *systemVDaemon) Start() error {
 		return nil
 	}
 
-	return exec.Command("service", da.name, "start").Run()
+	return da.conf.command("service", da.name, "start")
 }
 
 func (da *systemVDaemon) Stop() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -150,11 +330,11 @@ func (da *systemVDaemon) Stop() error {
 		return nil
 	}
 
-	return exec.Command("service", da.name, "stop").Run()
+	return da.conf.command("service", da.name, "stop")
 }
 
 func (da *systemVDaemon) Restart() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -162,11 +342,29 @@ func (da *systemVDaemon) Restart() error {
 		return errNoInstall
 	}
 
-	return exec.Command("service", da.name, "restart").Run()
+	return da.conf.command("service", da.name, "restart")
 }
 
-func (da *systemVDaemon) Status() error {
-	if !checkRootGroup() {
+func (da *systemVDaemon) Status() (*Status, error) {
+	if !da.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := da.describe()
+	st.Running, st.Enabled = da.isRunning(), da.isEnabled()
+	st.Args = shellArgsFromFile(da.serviceScrpitPath(), daemonArgsRe)
+	if st.Running {
+		st.PID = readPID(da.conf.path("/var/run/" + da.name + ".pid"))
+	}
+	return st.withState(), nil
+}
+
+func (da *systemVDaemon) Enable() error {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -174,11 +372,31 @@ func (da *systemVDaemon) Status() error {
 		return errNoInstall
 	}
 
-	if da.isRunning() {
-		return nil
+	if da.conf.offline() {
+		return da.link(&journal{conf: da.conf}, true)
+	}
+	if da.debian() {
+		return da.conf.command("update-rc.d", da.name, "enable")
+	}
+	return da.conf.command("chkconfig", da.name, "on")
+}
+
+func (da *systemVDaemon) Disable() error {
+	if !da.conf.privileged() {
+		return errPermit
 	}
 
-	return errStopped
+	if !da.IsInstalled() {
+		return errNoInstall
+	}
+
+	if da.conf.offline() {
+		return da.link(&journal{conf: da.conf}, false)
+	}
+	if da.debian() {
+		return da.conf.command("update-rc.d", da.name, "disable")
+	}
+	return da.conf.command("chkconfig", da.name, "off")
 }
 
 func (da *systemVDaemon) Run() error {
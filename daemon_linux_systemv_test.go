@@ -0,0 +1,268 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rhFunctions stands in for /etc/rc.d/init.d/functions, with the helpers the
+// Red Hat script calls
+const rhFunctions = `success() { printf "[  OK  ]"; }
+status() {
+    [ -f "$2" ] && kill -0 "$(cat "$2")" 2>/dev/null && echo "$3 is running" && return 0
+    echo "$3 is stopped"
+    return 3
+}
+killproc() {
+    kill "$(cat "$2")" && rm -f "$2"
+}
+`
+
+// lsbFunctions stands in for /lib/lsb/init-functions, with the helpers the
+// Debian script calls
+const lsbFunctions = `log_daemon_msg() { printf "%s: %s" "$1" "$2"; }
+log_end_msg() { [ "$1" -eq 0 ] && echo " ok" || echo " failed"; return "$1"; }
+status_of_proc() {
+    start-stop-daemon --status --pidfile "$2" && echo "$3 is running" && return 0
+    echo "$3 is stopped"
+    return 3
+}
+`
+
+// scriptTools are the commands the init scripts and their stand-in helpers
+// run besides the one that switches the user
+var scriptTools = []string{"cat", "chown", "date", "dirname", "mkdir", "rm", "sleep", "touch"}
+
+// scriptTest runs a rendered init script under /bin/sh, with its paths moved
+// into a temporary root, and checks the process it starts
+type scriptTest struct {
+	t       *testing.T
+	root    string
+	workDir string
+	exePath string
+	u       *user.User
+}
+
+func newScriptTest(t *testing.T) *scriptTest {
+	if os.Geteuid() != 0 {
+		t.Skip("the script starts the app as another user, it needs root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user on this host")
+	}
+
+	// nobody reaches the app through the temporary directories
+	root := t.TempDir()
+	for _, dir := range []string{filepath.Dir(root), root} {
+		if err := os.Chmod(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	workDir := filepath.Join(root, "opt", "app")
+	for _, dir := range []string{workDir, filepath.Join(root, "var", "run"), filepath.Join(root, "bin")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exePath := filepath.Join(workDir, "app")
+	sleeper := "#!/bin/sh\nprintf '<%s>\\n' \"$@\"\nexec sleep 300\n"
+	if err := ioutil.WriteFile(exePath, []byte(sleeper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &scriptTest{t, root, workDir, exePath, u}
+}
+
+// write writes the script data, with its paths moved into the root, and the
+// helper files it sources
+func (st *scriptTest) write(data []byte, helpers map[string]string) string {
+	st.t.Helper()
+	oldnew := []string{
+		"/etc/sysconfig/", st.root + "/etc/sysconfig/",
+		"/etc/default/", st.root + "/etc/default/",
+		"/var/run/", st.root + "/var/run/",
+		"/var/lock/", st.root + "/var/lock/",
+		"/var/log/", st.root + "/var/log/",
+	}
+	files := map[string]string{}
+	for path, helper := range helpers {
+		oldnew = append(oldnew, path, filepath.Join(st.root, filepath.Base(path)))
+		files[filepath.Join(st.root, filepath.Base(path))] = helper
+	}
+	path := filepath.Join(st.root, "app.init")
+	files[path] = strings.NewReplacer(oldnew...).Replace(string(data))
+	for path, data := range files {
+		if err := ioutil.WriteFile(path, []byte(data), 0755); err != nil {
+			st.t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// tools puts the commands into the bin directory of the root and returns a
+// PATH of it alone, so the script finds nothing else
+func (st *scriptTest) tools(names ...string) string {
+	st.t.Helper()
+	bin := filepath.Join(st.root, "bin")
+	for _, name := range names {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			st.t.Skipf("no %s on this host", name)
+		}
+		if err := os.Symlink(path, filepath.Join(bin, name)); err != nil && !os.IsExist(err) {
+			st.t.Fatal(err)
+		}
+	}
+	return "PATH=" + bin
+}
+
+// run runs the verb of the script with the environment env
+func (st *scriptTest) run(script, verb string, env ...string) error {
+	cmd := exec.Command("/bin/sh", script, verb)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	st.t.Logf("%s: %s", verb, out)
+	return err
+}
+
+func (st *scriptTest) pidfile() string {
+	return filepath.Join(st.root, "var", "run", "app.pid")
+}
+
+func (st *scriptTest) pid() int {
+	data, _ := ioutil.ReadFile(st.pidfile())
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// checkApp checks the process in the pidfile is the app, running in its
+// work directory as nobody with the group gid, and that it got its args
+func (st *scriptTest) checkApp(gid string) {
+	t := st.t
+	t.Helper()
+	pid := st.pid()
+	if pid == 0 {
+		t.Fatal("start wrote no pidfile")
+	}
+	t.Cleanup(func() {
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+	})
+
+	// The app execs sleep, the pidfile holds the PID of the app itself
+	var cmdline []byte
+	for i := 0; i < 50; i++ {
+		cmdline, _ = ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+		if strings.HasPrefix(string(cmdline), "sleep\x00") {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !strings.HasPrefix(string(cmdline), "sleep\x00") {
+		t.Fatalf("pid %d runs %q, want the app", pid, cmdline)
+	}
+	if cwd, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/cwd"); err != nil || cwd != st.workDir {
+		t.Errorf("app runs in %q (%v), want %q", cwd, err, st.workDir)
+	}
+	status, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range strings.Split(string(status), "\n") {
+		if f := strings.Fields(l); len(f) > 1 && f[0] == "Uid:" && f[1] != st.u.Uid {
+			t.Errorf("app runs as uid %s, want %s", f[1], st.u.Uid)
+		} else if len(f) > 1 && f[0] == "Gid:" && f[1] != gid {
+			t.Errorf("app runs as gid %s, want %s", f[1], gid)
+		}
+	}
+	logs, _ := ioutil.ReadFile(filepath.Join(st.root, "var", "log", "app", "app.log"))
+	if !strings.Contains(string(logs), "<--name>\n<two words>\n") {
+		t.Errorf("app got the args %q, want --name and \"two words\"", logs)
+	}
+}
+
+// TestSystemVScript runs the Red Hat init script with each of the commands
+// it switches the user with
+func TestSystemVScript(t *testing.T) {
+	for _, runner := range []string{"runuser", "setpriv", "chroot", "su"} {
+		t.Run(runner, func(t *testing.T) {
+			st := newScriptTest(t)
+			// A group other than the primary one shows the script set it, the
+			// plain su can only give the primary group
+			g, err := user.LookupGroup("daemon")
+			if err != nil || runner == "su" {
+				if g, err = user.LookupGroupId(st.u.Gid); err != nil {
+					t.Skip("no primary group for nobody on this host")
+				}
+			}
+
+			conf := &Config{User: st.u.Username, Group: g.Name}
+			data, err := (&systemVDaemon{st.exePath, "app", "App", nil, conf}).renderFor([]string{"--name", "two words"}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			script := st.write(data, map[string]string{"/etc/rc.d/init.d/functions": rhFunctions})
+			path := st.tools(append([]string{runner}, scriptTools...)...)
+
+			if err := st.run(script, "start", path); err != nil {
+				t.Fatalf("start: %v", err)
+			}
+			st.checkApp(g.Gid)
+			if err := st.run(script, "status", path); err != nil {
+				t.Errorf("status of the running app: %v", err)
+			}
+			if err := st.run(script, "stop", path); err != nil {
+				t.Fatalf("stop: %v", err)
+			}
+			if _, err := os.Stat(st.pidfile()); !os.IsNotExist(err) {
+				t.Errorf("stop left the pidfile: %v", err)
+			}
+			if err := st.run(script, "status", path); err == nil {
+				t.Error("status of the stopped app succeeded")
+			}
+		})
+	}
+}
+
+// TestSystemVDebianScript runs the Debian init script, which starts the app
+// with start-stop-daemon
+func TestSystemVDebianScript(t *testing.T) {
+	st := newScriptTest(t)
+	g, err := user.LookupGroup("daemon")
+	if err != nil {
+		t.Skip("no daemon group on this host")
+	}
+
+	conf := &Config{User: st.u.Username, Group: g.Name}
+	data, err := (&systemVDaemon{st.exePath, "app", "App", nil, conf}).renderFor([]string{"--name", "two words"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := st.write(data, map[string]string{"/lib/lsb/init-functions": lsbFunctions})
+	path := st.tools(append([]string{"start-stop-daemon"}, scriptTools...)...)
+
+	if err := st.run(script, "start", path); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	st.checkApp(g.Gid)
+	if err := st.run(script, "status", path); err != nil {
+		t.Errorf("status of the running app: %v", err)
+	}
+	if err := st.run(script, "stop", path); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if _, err := os.Stat(st.pidfile()); !os.IsNotExist(err) {
+		t.Errorf("stop left the pidfile: %v", err)
+	}
+	if err := st.run(script, "status", path); err == nil {
+		t.Error("status of the stopped app succeeded")
+	}
+}
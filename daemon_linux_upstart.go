@@ -1,11 +1,15 @@
 package daemon
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 type upstartDaemon struct {
@@ -13,20 +17,70 @@ type upstartDaemon struct {
 	name     string
 	descrip  string
 	dependes []string
+	conf     *Config
 }
 
 func (da *upstartDaemon) serviceScrpitPath() string {
-	return "/etc/init/" + da.name + ".conf"
+	return da.conf.path("/etc/init/" + da.name + ".conf")
 }
 
-func (da *upstartDaemon) isRunning() bool {
-	stdout, err := exec.Command("status", da.name).Output()
+func (da *upstartDaemon) overridePath() string {
+	return da.conf.path("/etc/init/" + da.name + ".override")
+}
+
+func (da *upstartDaemon) describe() *Status {
+	return &Status{Name: da.name, Backend: "upstart", Path: da.serviceScrpitPath()}
+}
+
+// logPath is the file console log makes upstart write the output of the job
+// to, upstart rotates it
+func (da *upstartDaemon) logPath() string {
+	return da.conf.path("/var/log/upstart/" + da.name + ".log")
+}
+
+var (
+	upstartArgsRe   = regexp.MustCompile(`(?m)^exec (.*)$`)
+	upstartManualRe = regexp.MustCompile(`(?m)^[ \t]*manual[ \t]*(?:\n|$)`)
+	upstartStatusRe = regexp.MustCompile(`^\S+ (start|stop)/([a-z-]+)(?:, process (\d+))?`)
+	// upstartQuote escapes a string between the double quotes of a stanza
+	upstartQuote = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// args returns the arguments the job is installed with, the words of its
+// exec line after the program
+func (da *upstartDaemon) args() []string {
+	words := splitShellWords(matchFile(da.serviceScrpitPath(), upstartArgsRe))
+	if len(words) < 2 {
+		return nil
+	}
+	return words[1:]
+}
+
+// status returns the goal and the state of the job and the PID of its main
+// process, like "start", "running" and 4242 for "app start/running, process
+// 4242". A job that is started or stopped keeps its goal while it goes
+// through states like spawned and stopping.
+func (da *upstartDaemon) status() (string, string, int) {
+	stdout, err := da.conf.output("status", da.name)
 	if err != nil {
-		return false
+		return "", "", 0
 	}
+	m := upstartStatusRe.FindSubmatch(stdout)
+	if m == nil {
+		return "", "", 0
+	}
+	pid, _ := strconv.Atoi(string(m[3]))
+	return string(m[1]), string(m[2]), pid
+}
 
-	matched, err := regexp.MatchString(da.name+" start/running", string(stdout))
-	return err == nil && matched
+func (da *upstartDaemon) pid() int {
+	_, _, pid := da.status()
+	return pid
+}
+
+func (da *upstartDaemon) isRunning() bool {
+	goal, state, _ := da.status()
+	return goal == "start" && state == "running"
 }
 
 func (da *upstartDaemon) IsInstalled() bool {
@@ -34,71 +88,134 @@ func (da *upstartDaemon) IsInstalled() bool {
 	return err == nil
 }
 
-func (da *upstartDaemon) Install(args ...string) error {
-	if !checkRootGroup() {
-		return errPermit
+// A job with the "manual" stanza in its override file is not started on boot
+func (da *upstartDaemon) isEnabled() bool {
+	data, err := ioutil.ReadFile(da.overridePath())
+	if err != nil {
+		return true
 	}
 
-	if da.IsInstalled() {
+	return !upstartManualRe.Match(data)
+}
+
+// setManual adds or removes the "manual" stanza of the override file, the
+// stanzas an admin put there are kept and the file is removed once empty
+func (da *upstartDaemon) setManual(manual bool) error {
+	path := da.overridePath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if upstartManualRe.Match(data) == manual {
 		return nil
 	}
 
+	if manual {
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			data = append(data, '\n')
+		}
+		return writeFile(path, append(data, "manual\n"...), 0644)
+	}
+	data = upstartManualRe.ReplaceAll(data, nil)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return removeFiles(path)
+	}
+	return writeFile(path, data, 0644)
+}
+
+// upstart keeps no record of how the app exited, only its log
+func (da *upstartDaemon) diagnose(lines int) (string, []string) {
+	return "", tailFile(da.logPath(), lines)
+}
+
+func (da *upstartDaemon) Install(args ...string) (err error) {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
 	// Create Upstart conf
 	path := da.serviceScrpitPath()
-	file, err := os.Create(path)
-	if err != nil {
+	if keep, err := keepInstalled(da.conf, path); keep || err != nil {
 		return err
 	}
-	defer file.Close()
 
-	templ, err := template.New("LinuxUpTemplate").Parse(LinuxUpTemplate)
+	data, err := da.render(args)
 	if err != nil {
 		return err
 	}
 
-	if err := templ.Execute(
-		file,
-		&struct {
-			Name, Description, Path, WorkDir, Args string
-		}{da.name, da.descrip, da.exePath, strings.TrimRight(da.exePath, da.name), strings.Join(args, " ")},
-	); err != nil {
+	j := &journal{conf: da.conf}
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
+
+	if err = j.mkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	if err = os.Chmod(path, 0644); err != nil {
+	if err = j.writeFile(path, withMarker(data), 0644); err != nil {
 		return err
 	}
 
-	// Create logratate conf
-	path = "/etc/logrotate.d/" + da.name
-	logfile, err := os.Create(path)
+	if da.conf.AutoStart || da.conf.reinstall {
+		return nil
+	}
+
+	return j.writeFile(da.overridePath(), []byte("manual\n"), 0644)
+}
+
+// render returns the job Install writes for args
+func (da *upstartDaemon) render(args []string) ([]byte, error) {
+	templ, err := template.New("LinuxUpTemplate").Parse(LinuxUpTemplate)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer logfile.Close()
 
-	if err = os.MkdirAll("/var/log/"+da.name, 0644); err != nil {
-		return err
+	env := da.conf.envList()
+	for i, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		env[i] = kv[0] + "=" + strconv.Quote(kv[1])
 	}
 
-	templ, err = template.New("LinuxLogRotateTemplate").Parse(LinuxLogRotateTemplate)
-	if err != nil {
-		return err
+	// kill timeout takes whole seconds
+	killTimeout := int((da.conf.KillTimeout + time.Second - 1) / time.Second)
+	normalExit := make([]string, len(da.conf.NormalExit))
+	for i, code := range da.conf.NormalExit {
+		normalExit[i] = strconv.Itoa(code)
+	}
+	var preStart string
+	if script := strings.TrimSpace(da.conf.PreStart); script != "" {
+		preStart = "    " + strings.Replace(script, "\n", "\n    ", -1)
 	}
 
-	if err = templ.Execute(
-		logfile,
+	var buf bytes.Buffer
+	if err := templ.Execute(
+		&buf,
 		&struct {
-			Name string
-		}{da.name},
+			Name, Description, Path, WorkDir, Args, Instance, User, Group string
+			Env                                                           []string
+			Limits                                                        Limits
+			KillTimeout                                                   int
+			NormalExit, PreStart                                          string
+		}{da.name, upstartQuote.Replace(da.descrip), shellWords([]string{da.exePath}), filepath.Dir(da.exePath), shellWords(args), da.conf.Instance,
+			da.conf.User, da.conf.Group, env, da.conf.Limits, killTimeout, strings.Join(normalExit, " "), preStart},
 	); err != nil {
-		return err
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	return os.Chmod(path, 0755)
+func (da *upstartDaemon) isCurrent(args ...string) bool {
+	want, err := da.render(args)
+	if err != nil {
+		return false
+	}
+	return isRendered(da.serviceScrpitPath(), want)
 }
 
 func (da *upstartDaemon) UnInstall() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -106,17 +223,28 @@ func (da *upstartDaemon) UnInstall() error {
 		return nil
 	}
 
-	if da.isRunning() {
+	if err := checkOwner(da.conf, da.serviceScrpitPath()); err != nil {
+		return err
+	}
+
+	if goal, _, _ := da.status(); goal == "start" {
 		if err := da.Stop(); err != nil {
 			return err
 		}
 	}
 
-	return os.Remove(da.serviceScrpitPath())
+	if err := removeFiles(da.overridePath(), da.serviceScrpitPath()); err != nil {
+		return err
+	}
+	if err := removeLogs(da.conf, da.name); err != nil || !da.conf.Purge {
+		return err
+	}
+	rotated, _ := filepath.Glob(da.logPath() + ".*")
+	return removeFiles(append(rotated, da.logPath())...)
 }
 
 func (da *upstartDaemon) Start() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -124,15 +252,16 @@ func (da *upstartDaemon) Start() error {
 		return errNoInstall
 	}
 
-	if da.isRunning() {
+	// start fails on a job that is already starting, like one spawned
+	if goal, _, _ := da.status(); goal == "start" {
 		return nil
 	}
 
-	return exec.Command("start", da.name).Run()
+	return da.conf.command("start", da.name)
 }
 
 func (da *upstartDaemon) Stop() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -140,15 +269,15 @@ func (da *upstartDaemon) Stop() error {
 		return errNoInstall
 	}
 
-	if !da.isRunning() {
+	if goal, _, _ := da.status(); goal != "start" {
 		return nil
 	}
 
-	return exec.Command("stop", da.name).Run()
+	return da.conf.command("stop", da.name)
 }
 
 func (da *upstartDaemon) Restart() error {
-	if !checkRootGroup() {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -156,11 +285,26 @@ func (da *upstartDaemon) Restart() error {
 		return errNoInstall
 	}
 
-	return exec.Command("restart", da.name).Run()
+	return da.conf.command("restart", da.name)
+}
+
+func (da *upstartDaemon) Status() (*Status, error) {
+	if !da.conf.privileged() {
+		return nil, errPermit
+	}
+
+	if !da.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := da.describe()
+	st.Running, st.Enabled = da.isRunning(), da.isEnabled()
+	st.PID, st.Args = da.pid(), da.args()
+	return st.withState(), nil
 }
 
-func (da *upstartDaemon) Status() error {
-	if !checkRootGroup() {
+func (da *upstartDaemon) Enable() error {
+	if !da.conf.privileged() {
 		return errPermit
 	}
 
@@ -168,11 +312,19 @@ func (da *upstartDaemon) Status() error {
 		return errNoInstall
 	}
 
-	if da.isRunning() {
-		return nil
+	return da.setManual(false)
+}
+
+func (da *upstartDaemon) Disable() error {
+	if !da.conf.privileged() {
+		return errPermit
+	}
+
+	if !da.IsInstalled() {
+		return errNoInstall
 	}
 
-	return errStopped
+	return da.setManual(true)
 }
 
 func (da *upstartDaemon) Run() error {
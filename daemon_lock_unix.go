@@ -0,0 +1,30 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir holds the lock files of the services
+func lockDir() string {
+	if _, err := os.Stat("/run"); err == nil {
+		return "/run/daemon"
+	}
+	return "/var/run/daemon"
+}
+
+// tryLock takes the flock of f, false when another process holds it
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
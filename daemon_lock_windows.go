@@ -0,0 +1,36 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockDir holds the lock files of the services
+func lockDir() string {
+	dir := os.Getenv("ProgramData")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "daemon")
+}
+
+// lockRange is the byte locked, past the holder written at the start of the
+// file so waiting processes can still read it
+func lockRange() *windows.Overlapped {
+	return &windows.Overlapped{OffsetHigh: 1}
+}
+
+// tryLock locks f, false when another process holds it
+func tryLock(f *os.File) (bool, error) {
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, lockRange())
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, lockRange())
+}
@@ -0,0 +1,597 @@
+//go:build linux
+// +build linux
+
+package daemon_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miaia/daemon"
+	"github.com/miaia/daemon/daemontest"
+)
+
+var backends = []struct {
+	backend daemontest.Backend
+	// file is the service file Install writes for app
+	file string
+	// fail is a command of the install made to fail, block a path made a
+	// directory to fail the backends whose install runs no command
+	fail  string
+	block string
+}{
+	{backend: daemontest.Systemd, file: "etc/systemd/system/app.service", fail: "systemctl enable"},
+	{backend: daemontest.Upstart, file: "etc/init/app.conf", block: "etc/init/app.override"},
+	{backend: daemontest.SysV, file: "etc/init.d/app", fail: "chkconfig --add"},
+	{backend: daemontest.SysVDebian, file: "etc/init.d/app", fail: "update-rc.d app defaults"},
+	{backend: daemontest.OpenRC, file: "etc/init.d/app", fail: "rc-update add"},
+	{backend: daemontest.Runit, file: "etc/sv/app/run", block: "var/service/app"},
+	{backend: daemontest.S6, file: "etc/s6/sv/app/run", block: "run/service/app"},
+	{backend: daemontest.Supervisor, file: "etc/supervisor/conf.d/app.conf", fail: "supervisorctl update"},
+}
+
+// newSystem returns a fake of backend and the config of the app service on it
+func newSystem(t *testing.T, backend daemontest.Backend, autoStart bool) (*daemontest.System, daemon.Config) {
+	t.Helper()
+	sys, err := daemontest.New(t.TempDir(), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := sys.Config(daemon.Config{
+		Name:      "app",
+		Exec:      "/usr/bin/app",
+		AutoStart: autoStart,
+		Quiet:     true,
+		Timeout:   200 * time.Millisecond,
+	})
+	return sys, conf
+}
+
+// notInstalled reports whether err is the status of a service that is not
+// installed, which is unknown to LSB
+func notInstalled(err error) bool {
+	return daemon.ExitCode(err) == daemon.ExitUnknown && strings.Contains(err.Error(), "not installed")
+}
+
+func TestLifecycle(t *testing.T) {
+	for _, tt := range backends {
+		t.Run(string(tt.backend), func(t *testing.T) {
+			sys, conf := newSystem(t, tt.backend, false)
+			run := func(verb string, args ...string) error {
+				t.Helper()
+				return daemon.RunCommand(conf, verb, args)
+			}
+
+			if err := run("install", "--port", "8080"); err != nil {
+				t.Fatalf("install: %v, commands: %v", err, sys.Calls())
+			}
+			if _, err := os.Stat(filepath.Join(sys.Root(), tt.file)); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			if sys.Enabled("app") {
+				t.Errorf("install: app enabled without AutoStart")
+			}
+
+			if err := run("enable"); err != nil {
+				t.Fatalf("enable: %v, commands: %v", err, sys.Calls())
+			}
+			if !sys.Enabled("app") {
+				t.Errorf("enable: app not enabled, commands: %v", sys.Calls())
+			}
+
+			if err := run("start"); err != nil {
+				t.Fatalf("start: %v, commands: %v", err, sys.Calls())
+			}
+			if !sys.Running("app") {
+				t.Errorf("start: app not running, commands: %v", sys.Calls())
+			}
+			if err := run("status"); err != nil {
+				t.Errorf("status of a running app: %v", err)
+			}
+
+			if err := run("stop"); err != nil {
+				t.Fatalf("stop: %v, commands: %v", err, sys.Calls())
+			}
+			if sys.Running("app") {
+				t.Errorf("stop: app still running, commands: %v", sys.Calls())
+			}
+			if err := run("status"); daemon.ExitCode(err) != daemon.ExitNotRunning {
+				t.Errorf("status of a stopped app: %v, want exit code %d", err, daemon.ExitNotRunning)
+			}
+
+			if err := run("disable"); err != nil {
+				t.Fatalf("disable: %v, commands: %v", err, sys.Calls())
+			}
+			if sys.Enabled("app") {
+				t.Errorf("disable: app still enabled, commands: %v", sys.Calls())
+			}
+
+			if err := run("uninstall"); err != nil {
+				t.Fatalf("uninstall: %v, commands: %v", err, sys.Calls())
+			}
+			if _, err := os.Stat(filepath.Join(sys.Root(), tt.file)); !os.IsNotExist(err) {
+				t.Errorf("uninstall left %s: %v", tt.file, err)
+			}
+			if err := run("status"); !notInstalled(err) {
+				t.Errorf("status after uninstall: %v, want not installed", err)
+			}
+		})
+	}
+}
+
+func TestInstallRollback(t *testing.T) {
+	for _, tt := range backends {
+		t.Run(string(tt.backend), func(t *testing.T) {
+			sys, conf := newSystem(t, tt.backend, tt.backend != daemontest.Upstart)
+			if tt.fail != "" {
+				sys.Fail(tt.fail, nil)
+			} else if err := os.MkdirAll(filepath.Join(sys.Root(), tt.block, "x"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := daemon.RunCommand(conf, "install", nil); err == nil {
+				t.Fatalf("install succeeded, commands: %v", sys.Calls())
+			}
+			if _, err := os.Stat(filepath.Join(sys.Root(), tt.file)); !os.IsNotExist(err) {
+				t.Errorf("failed install left %s: %v", tt.file, err)
+			}
+			if err := daemon.RunCommand(conf, "status", nil); !notInstalled(err) {
+				t.Errorf("status after a failed install: %v, want not installed", err)
+			}
+		})
+	}
+}
+
+func TestInstallNotOwned(t *testing.T) {
+	const foreign = "# written by hand\n"
+	for _, tt := range backends {
+		t.Run(string(tt.backend), func(t *testing.T) {
+			sys, conf := newSystem(t, tt.backend, true)
+			path := filepath.Join(sys.Root(), tt.file)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(foreign), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := daemon.RunCommand(conf, "install", nil)
+			if err == nil || !strings.Contains(err.Error(), "--force") {
+				t.Fatalf("install over a foreign file: %v, want it refused", err)
+			}
+			if data, _ := ioutil.ReadFile(path); string(data) != foreign {
+				t.Errorf("refused install changed %s to %q", tt.file, data)
+			}
+			if err := daemon.RunCommand(conf, "uninstall", nil); err == nil {
+				t.Errorf("uninstall of a foreign service succeeded")
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("refused uninstall removed %s: %v", tt.file, err)
+			}
+
+			conf.Force = true
+			if err := daemon.RunCommand(conf, "install", nil); err != nil {
+				t.Fatalf("install with Force: %v, commands: %v", err, sys.Calls())
+			}
+			if data, _ := ioutil.ReadFile(path); string(data) == foreign {
+				t.Errorf("install with Force kept the foreign %s", tt.file)
+			}
+		})
+	}
+}
+
+// captureStdout runs the command verb and returns what it printed
+func captureStdout(t *testing.T, conf daemon.Config, verb string, args ...string) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	done := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		done <- out
+	}()
+	err = daemon.RunCommand(conf, verb, args)
+	w.Close()
+	return strings.TrimSpace(string(<-done)), err
+}
+
+// applyManifest runs apply with the manifest data and returns what it printed
+func applyManifest(t *testing.T, conf daemon.Config, data string) (string, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "app.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return captureStdout(t, conf, "apply", path)
+}
+
+// TestArgsRoundTrip checks each backend reads back the arguments it wrote,
+// quotes and all
+func TestArgsRoundTrip(t *testing.T) {
+	args := []string{"--name", "two words", "it's", `say "hi"`, "$HOME", "50%", ""}
+	for _, tt := range backends {
+		t.Run(string(tt.backend), func(t *testing.T) {
+			sys, conf := newSystem(t, tt.backend, false)
+			if err := daemon.RunCommand(conf, "install", args); err != nil {
+				t.Fatalf("install: %v, commands: %v", err, sys.Calls())
+			}
+			conf.Output = "json"
+			out, err := captureStdout(t, conf, "status")
+			if daemon.ExitCode(err) != daemon.ExitNotRunning {
+				t.Fatalf("status: %v", err)
+			}
+			var st daemon.Status
+			if err := json.Unmarshal([]byte(out), &st); err != nil {
+				t.Fatalf("status output %q: %v", out, err)
+			}
+			if !reflect.DeepEqual(st.Args, args) {
+				t.Errorf("status args %q, want %q", st.Args, args)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	const manifest = "name: app\nexec: /usr/bin/app\nargs: [--port, \"%s\"]\n"
+	for _, tt := range backends {
+		t.Run(string(tt.backend), func(t *testing.T) {
+			sys, conf := newSystem(t, tt.backend, true)
+			conf.Quiet = false
+			apply := func(port, want string) {
+				t.Helper()
+				out, err := applyManifest(t, conf, fmt.Sprintf(manifest+"running: true\n", port))
+				if err != nil || out != want {
+					t.Fatalf("apply port %s: %q, %v, want %q, commands: %v", port, out, err, want, sys.Calls())
+				}
+			}
+
+			// supervisord starts a program with autostart when it reads it
+			if tt.backend == daemontest.Supervisor {
+				apply("8080", "app: install")
+			} else {
+				apply("8080", "app: install, start")
+			}
+			apply("8080", "app: no changes")
+			apply("9090", "app: reconfigure, restart")
+			if !sys.Running("app") || !sys.Enabled("app") {
+				t.Errorf("app not running and enabled after the reconfigure")
+			}
+			if data, _ := ioutil.ReadFile(filepath.Join(sys.Root(), tt.file)); !strings.Contains(string(data), "9090") {
+				t.Errorf("%s does not run the app on 9090:\n%s", tt.file, data)
+			}
+			apply("9090", "app: no changes")
+
+			// A manifest that leaves enabled out keeps the service disabled
+			if err := daemon.RunCommand(conf, "disable", nil); err != nil {
+				t.Fatal(err)
+			}
+			apply("7070", "app: reconfigure, restart")
+			if sys.Enabled("app") {
+				t.Errorf("reconfigure enabled the disabled app")
+			}
+			apply("7070", "app: no changes")
+		})
+	}
+}
+
+func TestApplyRollback(t *testing.T) {
+	sys, conf := newSystem(t, daemontest.Systemd, true)
+	conf.Quiet = false
+	if out, err := applyManifest(t, conf, "name: app\nexec: /usr/bin/app\nargs: [a]\nrunning: true\n"); err != nil {
+		t.Fatalf("apply: %q, %v", out, err)
+	}
+	unit := filepath.Join(sys.Root(), "etc/systemd/system/app.service")
+	before, err := ioutil.ReadFile(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reconfigure fails at the reload, the unit of a is put back
+	sys.Fail("systemctl daemon-reload", nil)
+	quiet := conf
+	quiet.Quiet = true
+	if _, err := applyManifest(t, quiet, "name: app\nexec: /usr/bin/app\nargs: [b]\n"); err == nil {
+		t.Fatalf("apply with a failing reload succeeded")
+	}
+	if after, _ := ioutil.ReadFile(unit); string(after) != string(before) {
+		t.Errorf("failed reconfigure left the unit\n%s\nwant\n%s", after, before)
+	}
+	if !sys.Running("app") {
+		t.Errorf("failed reconfigure stopped the app")
+	}
+	if out, err := applyManifest(t, conf, "name: app\nexec: /usr/bin/app\nargs: [a]\n"); err != nil || out != "app: no changes" {
+		t.Errorf("apply of the old manifest: %q, %v, want no changes", out, err)
+	}
+}
+
+func TestS6NotifyOff(t *testing.T) {
+	sys, conf := newSystem(t, daemontest.S6, true)
+	conf.Notify = true
+	const manifest = "name: app\nexec: /usr/bin/app\nrunning: true\n"
+	if out, err := applyManifest(t, conf, manifest); err != nil {
+		t.Fatalf("apply with Notify: %q, %v, commands: %v", out, err, sys.Calls())
+	}
+	fd := filepath.Join(sys.Root(), "etc/s6/sv/app/notification-fd")
+	if _, err := os.Stat(fd); err != nil {
+		t.Fatalf("apply with Notify: %v", err)
+	}
+
+	conf.Notify = false
+	conf.Quiet = false
+	if out, err := applyManifest(t, conf, manifest); err != nil || out != "app: reconfigure, restart" {
+		t.Fatalf("apply without Notify: %q, %v, want a reconfigure", out, err)
+	}
+	if _, err := os.Stat(fd); !os.IsNotExist(err) {
+		t.Errorf("apply without Notify left notification-fd: %v", err)
+	}
+	if out, err := applyManifest(t, conf, manifest); err != nil || out != "app: no changes" {
+		t.Errorf("second apply without Notify: %q, %v, want no changes", out, err)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	sys, conf := newSystem(t, daemontest.Systemd, false)
+	crash := conf
+	crash.Name = "crash"
+	sys.Crash("crash")
+	tests := []struct {
+		name string
+		conf daemon.Config
+		args []string
+		want int
+	}{
+		{"unknown verb", conf, []string{"frobnicate"}, daemon.ExitUsage},
+		{"bad flag", conf, []string{"start", "--no-such-flag"}, daemon.ExitUsage},
+		{"status not installed", conf, []string{"status"}, daemon.ExitUnknown},
+		{"stop not installed", conf, []string{"stop"}, daemon.ExitNotInstalled},
+		{"install", conf, []string{"install"}, daemon.ExitOK},
+		{"status stopped", conf, []string{"status"}, daemon.ExitNotRunning},
+		{"start", conf, []string{"start"}, daemon.ExitOK},
+		{"status running", conf, []string{"status"}, daemon.ExitOK},
+		{"install crash", crash, []string{"install"}, daemon.ExitOK},
+		{"start crash", crash, []string{"start"}, daemon.ExitFailure},
+	}
+	for _, tt := range tests {
+		if got := daemon.ExitCode(daemon.Execute(tt.conf, tt.args)); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d, commands: %v", tt.name, got, tt.want, sys.Calls())
+		}
+	}
+}
+
+func TestOutputJSON(t *testing.T) {
+	sys, conf := newSystem(t, daemontest.Systemd, true)
+	conf.Output = "json"
+	decode := func(verb string) map[string]interface{} {
+		t.Helper()
+		out, _ := captureStdout(t, conf, verb, "--port", "8080")
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(out), &v); err != nil {
+			t.Fatalf("%s printed %q: %v", verb, out, err)
+		}
+		return v
+	}
+
+	v := decode("status")
+	if v["state"] != "not-installed" || v["exit_code"] != float64(daemon.ExitUnknown) {
+		t.Errorf("status of a missing app: %v", v)
+	}
+	if e, ok := v["error"].(map[string]interface{}); !ok || e["code"] != float64(daemon.ExitUnknown) || e["message"] == "" {
+		t.Errorf("status of a missing app has the error %v", v["error"])
+	}
+
+	// start installs the missing app
+	v = decode("start")
+	if !sys.Running("app") {
+		t.Fatalf("start did not start the app, commands: %v", sys.Calls())
+	}
+	want := map[string]interface{}{
+		"command":   "start",
+		"name":      "app",
+		"backend":   "systemd",
+		"state":     "running",
+		"running":   true,
+		"enabled":   true,
+		"unit_path": filepath.Join(sys.Root(), "etc/systemd/system/app.service"),
+		"args":      []interface{}{"--port", "8080"},
+		"exit_code": float64(0),
+	}
+	pid, ok := v["pid"].(float64)
+	if !ok || pid <= 0 {
+		t.Errorf("start printed the pid %v", v["pid"])
+	}
+	delete(v, "pid")
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("start printed\n%v\nwant\n%v", v, want)
+	}
+}
+
+// TestEnableRollback fails the command that enables the service at the end
+// of the install, and checks nothing of the install is left
+func TestEnableRollback(t *testing.T) {
+	for _, tt := range backends {
+		if tt.fail == "" {
+			continue
+		}
+		t.Run(string(tt.backend), func(t *testing.T) {
+			sys, conf := newSystem(t, tt.backend, true)
+			lockDir(t, sys.Root())
+			before := tree(t, sys.Root())
+			sys.Fail(tt.fail, nil)
+
+			if err := daemon.RunCommand(conf, "install", []string{"--port", "8080"}); err == nil {
+				t.Fatalf("install succeeded, commands: %v", sys.Calls())
+			}
+			if after := tree(t, sys.Root()); !reflect.DeepEqual(after, before) {
+				t.Errorf("failed install left\n%v\nwant\n%v", after, before)
+			}
+			if sys.Running("app") || sys.Enabled("app") {
+				t.Errorf("failed install left the app running or enabled")
+			}
+		})
+	}
+}
+
+// lockDir creates the directory the commands lock the services in under
+// root and returns it
+func lockDir(t *testing.T, root string) string {
+	t.Helper()
+	dir := filepath.Join(root, "run/daemon")
+	if _, err := os.Stat("/run"); err != nil {
+		dir = filepath.Join(root, "var/run/daemon")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// tree lists the files, directories and links under root, the lock files
+// aside
+func tree(t *testing.T, root string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if strings.HasSuffix(rel, ".lock") {
+			return nil
+		}
+		paths = append(paths, rel+" "+info.Mode().String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestLockContention(t *testing.T) {
+	sys, conf := newSystem(t, daemontest.Systemd, false)
+	if err := daemon.RunCommand(conf, "install", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another command holds the lock of app
+	path := filepath.Join(lockDir(t, sys.Root()), "app.lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+	const holder = "pid 4242 since 2024-05-02T09:30:00Z"
+	if _, err := f.WriteString(holder + "\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.LockTimeout = 300 * time.Millisecond
+	err = daemon.RunCommand(conf, "start", nil)
+	want := "Service is locked by another process, " + holder + " holds " + path + ", waited 300ms"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("start while locked: %v, want %q", err, want)
+	}
+	if sys.Running("app") {
+		t.Errorf("start ran while the lock was held")
+	}
+
+	// The command goes on once the lock is released
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if err := daemon.RunCommand(conf, "start", nil); err != nil {
+		t.Errorf("start after the lock was released: %v", err)
+	}
+}
+
+// TestOffline installs into a root with no Executor, where the links the
+// enable commands would make are made directly
+func TestOffline(t *testing.T) {
+	tests := []struct {
+		name string
+		// detect is the file the init system of the root is recognized by
+		detect string
+		// links are the links enable makes, and their targets, disabled the
+		// ones disable leaves
+		links, disabled map[string]string
+	}{
+		{"systemd", "lib/systemd/systemd", map[string]string{
+			"etc/systemd/system/multi-user.target.wants/app.service": "/etc/systemd/system/app.service",
+		}, nil},
+		{"openrc", "sbin/openrc-run", map[string]string{
+			"etc/runlevels/default/app": "/etc/init.d/app",
+		}, nil},
+		{"sysv", "", map[string]string{
+			"etc/rc0.d/K17app": "../init.d/app", "etc/rc1.d/K17app": "../init.d/app",
+			"etc/rc2.d/S98app": "../init.d/app", "etc/rc3.d/S98app": "../init.d/app",
+			"etc/rc4.d/S98app": "../init.d/app", "etc/rc5.d/S98app": "../init.d/app",
+			"etc/rc6.d/K17app": "../init.d/app",
+		}, map[string]string{
+			// chkconfig off stops the script in every runlevel
+			"etc/rc0.d/K17app": "../init.d/app", "etc/rc1.d/K17app": "../init.d/app",
+			"etc/rc2.d/K17app": "../init.d/app", "etc/rc3.d/K17app": "../init.d/app",
+			"etc/rc4.d/K17app": "../init.d/app", "etc/rc5.d/K17app": "../init.d/app",
+			"etc/rc6.d/K17app": "../init.d/app",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.detect != "" {
+				if err := os.MkdirAll(filepath.Join(root, filepath.Dir(tt.detect)), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(root, tt.detect), nil, 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			conf := daemon.Config{Name: "app", Exec: "/usr/bin/app", Root: root, AutoStart: true, Quiet: true}
+
+			if err := daemon.RunCommand(conf, "install", nil); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			for link, target := range tt.links {
+				if got, err := os.Readlink(filepath.Join(root, link)); err != nil || got != target {
+					t.Errorf("install made %s -> %q, %v, want %q", link, got, err, target)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(root, "run/daemon")); !os.IsNotExist(err) {
+				t.Errorf("offline install left a lock directory: %v", err)
+			}
+			if err := daemon.RunCommand(conf, "start", nil); err == nil {
+				t.Errorf("offline start succeeded")
+			}
+
+			if err := daemon.RunCommand(conf, "disable", nil); err != nil {
+				t.Fatalf("disable: %v", err)
+			}
+			for link := range tt.links {
+				if _, ok := tt.disabled[link]; ok {
+					continue
+				}
+				if got, err := os.Readlink(filepath.Join(root, link)); err == nil {
+					t.Errorf("disable left %s -> %s", link, got)
+				}
+			}
+			for link, target := range tt.disabled {
+				if got, err := os.Readlink(filepath.Join(root, link)); err != nil || got != target {
+					t.Errorf("disable made %s -> %q, %v, want %q", link, got, err, target)
+				}
+			}
+		})
+	}
+}
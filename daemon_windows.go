@@ -5,9 +5,11 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/mgr"
@@ -18,6 +20,7 @@ type windowsDaemon struct {
 	name     string
 	descrip  string
 	dependes []string
+	conf     *Config
 }
 
 type systemError struct {
@@ -141,8 +144,21 @@ var (
 	}
 )
 
-func newDaemon(exepath, appName, serverName string) (daemon, error) {
-	return &windowsDaemon{exepath, serverName, appName + " server daemon", []string{""}}, nil
+func newDaemon(exepath, serverName string, conf *Config) (daemon, error) {
+	serverName = escapeName(serverName, func(r rune) bool {
+		return r != '\\'
+	})
+	if conf.Instance != "" {
+		serverName += "@" + conf.Instance
+	}
+	return &windowsDaemon{exepath, serverName, conf.Description, []string{""}, conf}, nil
+}
+
+func (win *windowsDaemon) startType() uint32 {
+	if win.conf.AutoStart {
+		return mgr.StartAutomatic
+	}
+	return mgr.StartManual
 }
 
 func toWinError(err error) error {
@@ -157,6 +173,40 @@ func toWinError(err error) error {
 	return err
 }
 
+func (win *windowsDaemon) describe() *Status {
+	return &Status{Name: win.name, Backend: "windows", Path: `HKLM\SYSTEM\CurrentControlSet\Services\` + win.name}
+}
+
+// query returns the process id and the command line of the service
+func (win *windowsDaemon) query() (int, []string) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return 0, nil
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(win.name)
+	if err != nil {
+		return 0, nil
+	}
+	defer s.Close()
+
+	var pid int
+	if status, err := s.Query(); err == nil {
+		pid = int(status.ProcessId)
+	}
+	c, err := s.Config()
+	if err != nil {
+		return pid, nil
+	}
+	// The command line holds the program and the arguments, each quoted
+	// the way EscapeArg quotes it
+	words, err := windows.DecomposeCommandLine(c.BinaryPathName)
+	if err != nil || len(words) < 2 {
+		return pid, nil
+	}
+	return pid, words[1:]
+}
+
 func (win *windowsDaemon) IsInstalled() bool {
 	m, err := mgr.Connect()
 	if err != nil {
@@ -173,7 +223,7 @@ func (win *windowsDaemon) IsInstalled() bool {
 	return true
 }
 
-func (win *windowsDaemon) Install(args ...string) error {
+func (win *windowsDaemon) Install(args ...string) (err error) {
 	// var n uint32
 	// b := make([]uint16, syscall.MAX_PATH)
 	// size := uint32(len(b))
@@ -195,22 +245,68 @@ func (win *windowsDaemon) Install(args ...string) error {
 	}
 	defer m.Disconnect()
 
+	// Display names must be unique as well
+	displayName := win.conf.DisplayName
+	if win.conf.Instance != "" {
+		displayName += " " + win.conf.Instance
+	}
+
+	// prev is the config of a service taken over, restored on failure
+	var prev *mgr.Config
 	s, err := m.OpenService(win.name)
 	if err == nil {
-		s.Close()
-		return nil
+		defer s.Close()
+		owned := markerRe.MatchString(managedBy(win.name))
+		if owned && !win.conf.reinstall {
+			return nil
+		}
+		if !owned && !win.conf.Force {
+			return fmt.Errorf("%s: %w", win.name, errNotOwned)
+		}
+
+		// Take the service over, or update the one installed before, as
+		// CreateService would have set it up
+		c, err := s.Config()
+		if err != nil {
+			return toWinError(err)
+		}
+		old := c
+		prev = &old
+		c.BinaryPathName = syscall.EscapeArg(win.exePath)
+		for _, arg := range args {
+			c.BinaryPathName += " " + syscall.EscapeArg(arg)
+		}
+		c.DisplayName, c.Description = displayName, win.descrip
+		c.StartType, c.Dependencies = win.startType(), win.dependes
+		if err = s.UpdateConfig(c); err != nil {
+			return toWinError(err)
+		}
+	} else {
+		s, err = m.CreateService(win.name, win.exePath, mgr.Config{
+			DisplayName:  displayName,
+			Description:  win.descrip,
+			StartType:    win.startType(),
+			Dependencies: win.dependes,
+		}, args...)
+		if err != nil {
+			return toWinError(err)
+		}
+		defer s.Close()
 	}
 
-	s, err = m.CreateService(win.name, win.exePath, mgr.Config{
-		DisplayName:  win.name,
-		Description:  win.descrip,
-		StartType:    mgr.StartAutomatic,
-		Dependencies: win.dependes,
-	}, args...)
-	if err != nil {
-		return toWinError(err)
+	// Undo the install when the rest of the setup fails, as the journal does
+	// for the files of the other init systems
+	j := &journal{conf: win.conf}
+	if prev != nil {
+		j.add(func() error { return s.UpdateConfig(*prev) })
+	} else {
+		j.add(s.Delete)
 	}
-	defer s.Close()
+	defer func() {
+		if err != nil {
+			err = j.rollback(err)
+		}
+	}()
 
 	r := []mgr.RecoveryAction{
 		mgr.RecoveryAction{
@@ -231,10 +327,86 @@ func (win *windowsDaemon) Install(args ...string) error {
 		return toWinError(err)
 	}
 
-	return nil
+	// The service control manager passes this value as the service environment
+	env := []string{serviceEnv + "=" + win.name}
+	if win.conf.Instance != "" {
+		env = append(env, instanceEnv+"="+win.conf.Instance)
+	}
+	env = append(env, win.conf.envList()...)
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+win.name, registry.SET_VALUE)
+	if err != nil {
+		return toWinError(err)
+	}
+	defer key.Close()
+
+	if err = key.SetStringsValue("Environment", env); err != nil {
+		return toWinError(err)
+	}
+	// Services have no definition file to mark, the marker is a value of their key
+	return key.SetStringValue("ManagedBy", marker())
+}
+
+// managedBy returns the ownership marker of the service, empty when this
+// package did not install it
+func managedBy(name string) string {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+name, registry.QUERY_VALUE)
+	if err != nil {
+		return ""
+	}
+	defer key.Close()
+	v, _, _ := key.GetStringValue("ManagedBy")
+	return v
+}
+
+// listDaemons returns the services this package installed
+func listDaemons(conf *Config) ([]daemon, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return nil, toWinError(err)
+	}
+	defer m.Disconnect()
+	names, err := m.ListServices()
+	if err != nil {
+		return nil, toWinError(err)
+	}
+
+	var ds []daemon
+	for _, name := range names {
+		if !markerRe.MatchString(managedBy(name)) {
+			continue
+		}
+		// query needs the binary path to tell the arguments apart
+		var exePath string
+		if s, err := m.OpenService(name); err == nil {
+			if c, err := s.Config(); err == nil && strings.HasPrefix(c.BinaryPathName, `"`) {
+				exePath = strings.SplitN(c.BinaryPathName[1:], `"`, 2)[0]
+			}
+			s.Close()
+		}
+		ds = append(ds, &windowsDaemon{exePath, name, "", []string{""}, conf})
+	}
+	return ds, nil
+}
+
+// Only the arguments are compared, the service control manager keeps the rest
+func (win *windowsDaemon) isCurrent(args ...string) bool {
+	_, installed := win.query()
+	if len(installed) != len(args) {
+		return false
+	}
+	for i := range args {
+		if installed[i] != args[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func (win *windowsDaemon) UnInstall() error {
+	if win.IsInstalled() && !win.conf.Force && !markerRe.MatchString(managedBy(win.name)) {
+		return fmt.Errorf("%s: %w", win.name, errNotOwned)
+	}
+
 	win.Stop()
 	m, err := mgr.Connect()
 	if err != nil {
@@ -342,20 +514,104 @@ func (win *windowsDaemon) status() svc.State {
 	return status.State
 }
 
-func (win *windowsDaemon) Status() error {
+// The service control manager keeps the exit code but no log
+func (win *windowsDaemon) diagnose(lines int) (string, []string) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", nil
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(win.name)
+	if err != nil {
+		return "", nil
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return "", nil
+	}
+
+	return fmt.Sprintf("Win32ExitCode=%d ServiceSpecificExitCode=%d", status.Win32ExitCode, status.ServiceSpecificExitCode), nil
+}
+
+func (win *windowsDaemon) isRunning() bool {
 	switch win.status() {
 	case svc.StartPending:
 		fallthrough
 	case svc.Running:
 		fallthrough
 	case svc.ContinuePending:
-		return nil
+		return true
+	}
+	return false
+}
+
+func (win *windowsDaemon) isEnabled() bool {
+	m, err := mgr.Connect()
+	if err != nil {
+		return false
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(win.name)
+	if err != nil {
+		return false
 	}
-	return errStopped
+	defer s.Close()
+	c, err := s.Config()
+	if err != nil {
+		return false
+	}
+
+	return c.StartType == mgr.StartAutomatic
+}
+
+func (win *windowsDaemon) Status() (*Status, error) {
+	if !win.IsInstalled() {
+		return nil, errNoInstall
+	}
+
+	st := win.describe()
+	st.Running, st.Enabled = win.isRunning(), win.isEnabled()
+	st.PID, st.Args = win.query()
+	if m := markerRe.FindStringSubmatch(managedBy(win.name)); m != nil {
+		st.Version, st.Installed = m[1], m[2]
+	}
+	return st.withState(), nil
+}
+
+func (win *windowsDaemon) setStartType(startType uint32) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return toWinError(err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(win.name)
+	if err != nil {
+		return errNoInstall
+	}
+	defer s.Close()
+	c, err := s.Config()
+	if err != nil {
+		return toWinError(err)
+	}
+	c.StartType = startType
+	if err = s.UpdateConfig(c); err != nil {
+		return toWinError(err)
+	}
+
+	return nil
+}
+
+func (win *windowsDaemon) Enable() error {
+	return win.setStartType(mgr.StartAutomatic)
+}
+
+func (win *windowsDaemon) Disable() error {
+	return win.setStartType(mgr.StartManual)
 }
 
 func (win *windowsDaemon) Restart() error {
-	if win.Status() == nil {
+	if win.isRunning() {
 		if err := win.Stop(); err != nil {
 			return err
 		}
@@ -0,0 +1,662 @@
+// Package daemontest fakes the Linux init systems, so the install, start,
+// stop and status flows of the daemon package can be tested as an
+// unprivileged user:
+//
+//	sys, err := daemontest.New(t.TempDir(), daemontest.Systemd)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	conf := sys.Config(daemon.Config{Name: "app", AutoStart: true})
+//	if err := daemon.RunCommand(conf, "start", []string{"--port", "8080"}); err != nil {
+//		t.Fatal(err)
+//	}
+//	if !sys.Running("app") || !sys.Enabled("app") {
+//		t.Fatalf("app not running, commands: %v", sys.Calls())
+//	}
+//
+// The service files are written under the directory given to New, the fake
+// answers systemctl, journalctl, service, chkconfig, the upstart commands,
+// update-rc.d, rc-service, rc-update, sv, s6-svc, s6-svstat and
+// supervisorctl, and keeps the state of every unit in memory.
+package daemontest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/miaia/daemon"
+)
+
+// Backend is the init system System plays
+type Backend string
+
+// The init systems System can play
+const (
+	Systemd Backend = "systemd"
+	Upstart Backend = "upstart"
+	SysV    Backend = "sysv"
+	// SysVDebian is SysV with update-rc.d instead of chkconfig
+	SysVDebian Backend = "sysv-debian"
+	OpenRC     Backend = "openrc"
+	Runit      Backend = "runit"
+	S6         Backend = "s6"
+	Supervisor Backend = "supervisord"
+)
+
+// System is a fake init system, it implements daemon.Executor
+type System struct {
+	root    string
+	backend Backend
+
+	mu      sync.Mutex
+	calls   [][]string
+	units   map[string]*unit
+	fail    map[string]error
+	nextPID int
+}
+
+type unit struct {
+	running, enabled bool
+	// crash makes the unit exit right after it starts
+	crash bool
+	pid   int
+	// loaded is set once supervisord read the program
+	loaded bool
+}
+
+// ExitError is returned by a command that fails, like the exit status of a
+// real one
+type ExitError struct {
+	Command []string
+	Code    int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// New returns a fake of backend whose files live under root. It creates the
+// directories, and the files the daemon package detects the init system by.
+func New(root string, backend Backend) (*System, error) {
+	var dirs []string
+	switch backend {
+	case Systemd:
+		dirs = []string{"run/systemd/system", "etc/systemd/system", "etc/default"}
+	case Upstart:
+		dirs = []string{"sbin", "etc/init", "etc/logrotate.d"}
+	case SysV:
+		dirs = []string{"etc/init.d", "etc/logrotate.d"}
+	case SysVDebian:
+		dirs = []string{"usr/sbin", "etc/init.d", "etc/logrotate.d"}
+	case OpenRC:
+		dirs = []string{"sbin", "etc/init.d", "etc/runlevels/default", "etc/logrotate.d"}
+	case Runit:
+		dirs = []string{"etc/runit/runsvdir", "etc/sv", "var/service"}
+	case S6:
+		dirs = []string{"run/service/.s6-svscan", "etc/s6/sv"}
+	case Supervisor:
+		dirs = []string{"etc/supervisor/conf.d"}
+	default:
+		return nil, fmt.Errorf("daemontest: unknown backend %q", backend)
+	}
+	for _, dir := range append(dirs, "var/run") {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	// The daemon package detects upstart, OpenRC and supervisord by their
+	// programs or config
+	detect := map[Backend]string{Upstart: "sbin/initctl", OpenRC: "sbin/openrc-run", Supervisor: "etc/supervisor/supervisord.conf",
+		SysVDebian: "usr/sbin/update-rc.d"}
+	if path, ok := detect[backend]; ok {
+		if err := ioutil.WriteFile(filepath.Join(root, path), nil, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &System{
+		root:    root,
+		backend: backend,
+		units:   map[string]*unit{},
+		fail:    map[string]error{},
+		nextPID: 1000,
+	}, nil
+}
+
+// Root is the directory the service files are written under
+func (s *System) Root() string {
+	return s.root
+}
+
+// Config returns conf set up to install and control services on s
+func (s *System) Config(conf daemon.Config) daemon.Config {
+	conf.Root = s.root
+	conf.Executor = s
+	return conf
+}
+
+// Calls returns the commands run so far, in order
+func (s *System) Calls() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := make([][]string, len(s.calls))
+	for i, c := range s.calls {
+		calls[i] = append([]string(nil), c...)
+	}
+	return calls
+}
+
+// Running reports whether the unit, job or script name runs
+func (s *System) Running(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.units[name]
+	return ok && u.running
+}
+
+// Enabled reports whether name starts at boot
+func (s *System) Enabled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Upstart has no command to enable a job, a "manual" override disables it
+	switch s.backend {
+	case Upstart:
+		data, err := ioutil.ReadFile(filepath.Join(s.root, "etc/init", name+".override"))
+		return s.exists(name) && (err != nil || !strings.Contains(string(data), "manual"))
+	case OpenRC:
+		_, err := os.Lstat(filepath.Join(s.root, "etc/runlevels/default", name))
+		return err == nil
+	case Runit:
+		// A linked service starts unless it has a down file
+		_, err := os.Lstat(filepath.Join(s.root, "var/service", name))
+		_, down := os.Stat(filepath.Join(s.root, "etc/sv", name, "down"))
+		return err == nil && down != nil
+	case S6:
+		_, err := os.Lstat(filepath.Join(s.root, "run/service", name))
+		_, down := os.Stat(filepath.Join(s.root, "etc/s6/sv", name, "down"))
+		return err == nil && down != nil
+	case Supervisor:
+		return s.autoStart(name)
+	case SysVDebian:
+		links, _ := filepath.Glob(filepath.Join(s.root, "etc/rc[2-5].d/S[0-9][0-9]"+name))
+		return len(links) > 0
+	}
+	u, ok := s.units[name]
+	return ok && u.enabled
+}
+
+// Crash makes name exit right after it is started, the start command itself
+// succeeds like it does on the real init systems
+func (s *System) Crash(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unit(name).crash = true
+}
+
+// Fail makes the commands starting with the words of command fail with err,
+// or with exit status 1 when err is nil. Fail("systemctl enable", nil) fails
+// every enable.
+func (s *System) Fail(command string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail[command] = err
+}
+
+func (s *System) unit(name string) *unit {
+	u, ok := s.units[name]
+	if !ok {
+		u = &unit{}
+		s.units[name] = u
+	}
+	return u
+}
+
+// exists reports whether the service file of name is installed
+func (s *System) exists(name string) bool {
+	var path string
+	switch s.backend {
+	case Systemd:
+		path = "etc/systemd/system/" + name + ".service"
+		if i := strings.Index(name, "@"); i >= 0 {
+			path = "etc/systemd/system/" + name[:i+1] + ".service"
+		}
+	case Upstart:
+		path = "etc/init/" + name + ".conf"
+	case Runit:
+		path = "etc/sv/" + name + "/run"
+	case S6:
+		path = "etc/s6/sv/" + name + "/run"
+	case Supervisor:
+		path = "etc/supervisor/conf.d/" + name + ".conf"
+	default:
+		path = "etc/init.d/" + name
+	}
+	_, err := os.Stat(filepath.Join(s.root, path))
+	return err == nil
+}
+
+func (s *System) start(name string) {
+	u := s.unit(name)
+	if u.crash {
+		u.running, u.pid = false, 0
+		return
+	}
+	if !u.running {
+		s.nextPID++
+		u.running, u.pid = true, s.nextPID
+	}
+	// SysV scripts keep the PID in a pidfile, supervise-daemon in its state
+	switch s.backend {
+	case SysV, SysVDebian:
+		ioutil.WriteFile(filepath.Join(s.root, "var/run", name+".pid"), []byte(strconv.Itoa(u.pid)+"\n"), 0644)
+	case OpenRC:
+		dir := filepath.Join(s.root, "run/openrc/options", name)
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, "child_pid"), []byte(strconv.Itoa(u.pid)), 0644)
+	}
+}
+
+func (s *System) stop(name string) {
+	u := s.unit(name)
+	u.running, u.pid = false, 0
+	switch s.backend {
+	case SysV, SysVDebian:
+		os.Remove(filepath.Join(s.root, "var/run", name+".pid"))
+	case OpenRC:
+		os.RemoveAll(filepath.Join(s.root, "run/openrc/options", name))
+	}
+}
+
+// Run runs the fake command name, it implements daemon.Executor
+func (s *System) Run(name string, args ...string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmd := append([]string{name}, args...)
+	s.calls = append(s.calls, cmd)
+	line := strings.Join(cmd, " ")
+	for prefix, err := range s.fail {
+		if line == prefix || strings.HasPrefix(line, prefix+" ") {
+			if err == nil {
+				err = &ExitError{cmd, 1}
+			}
+			return nil, err
+		}
+	}
+
+	switch name {
+	case "systemctl":
+		return s.systemctl(cmd, args)
+	case "journalctl":
+		return nil, nil
+	case "service":
+		return s.service(cmd, args)
+	case "chkconfig":
+		return s.chkconfig(cmd, args)
+	case "update-rc.d":
+		return s.updateRCD(cmd, args)
+	case "start", "stop", "restart", "status":
+		return s.upstart(cmd, args)
+	case "rc-service":
+		return s.rcService(cmd, args)
+	case "rc-update":
+		return s.rcUpdate(cmd, args)
+	case "sv":
+		return s.sv(cmd, args)
+	case "s6-svscanctl":
+		return nil, nil
+	case "s6-svc", "s6-svstat":
+		return s.s6(cmd, args)
+	case "supervisorctl":
+		return s.supervisorctl(cmd, args)
+	}
+	return nil, fmt.Errorf("daemontest: unknown command %s", line)
+}
+
+func (s *System) systemctl(cmd, args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, &ExitError{cmd, 1}
+	}
+	name := args[len(args)-1]
+	switch args[0] {
+	case "daemon-reload", "reset-failed":
+		return nil, nil
+	case "show":
+		u := s.unit(name)
+		var out string
+		for i := 1; i+1 < len(args); i += 2 {
+			switch args[i+1] {
+			case "MainPID":
+				out += fmt.Sprintf("MainPID=%d\n", u.pid)
+			case "Result":
+				if u.crash {
+					out += "Result=exit-code\n"
+				} else {
+					out += "Result=success\n"
+				}
+			case "ExecMainStatus":
+				if u.crash {
+					out += "ExecMainStatus=1\n"
+				} else {
+					out += "ExecMainStatus=0\n"
+				}
+			}
+		}
+		return []byte(out), nil
+	case "is-enabled":
+		if !s.unit(name).enabled {
+			return nil, &ExitError{cmd, 1}
+		}
+		return nil, nil
+	case "status":
+		if !s.unit(name).running {
+			return []byte("   Active: inactive (dead)\n"), &ExitError{cmd, 3}
+		}
+		return []byte("   Active: active (running)\n"), nil
+	}
+
+	if !s.exists(name) {
+		return nil, &ExitError{cmd, 5}
+	}
+	switch args[0] {
+	case "start":
+		s.start(name)
+	case "stop":
+		s.stop(name)
+	case "restart":
+		s.stop(name)
+		s.start(name)
+	case "enable":
+		s.unit(name).enabled = true
+	case "disable":
+		s.unit(name).enabled = false
+	default:
+		return nil, &ExitError{cmd, 1}
+	}
+	return nil, nil
+}
+
+func (s *System) service(cmd, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, &ExitError{cmd, 2}
+	}
+	name := args[0]
+	if !s.exists(name) {
+		return nil, &ExitError{cmd, 1}
+	}
+	switch args[1] {
+	case "start":
+		s.start(name)
+	case "stop":
+		s.stop(name)
+	case "restart":
+		s.stop(name)
+		s.start(name)
+	case "status":
+		u := s.unit(name)
+		if !u.running {
+			return []byte(name + " is stopped\n"), &ExitError{cmd, 3}
+		}
+		return []byte(fmt.Sprintf("%s (pid %d) is running...\n", name, u.pid)), nil
+	default:
+		return nil, &ExitError{cmd, 2}
+	}
+	return nil, nil
+}
+
+func (s *System) chkconfig(cmd, args []string) ([]byte, error) {
+	switch {
+	case len(args) == 2 && args[0] == "--add":
+		if !s.exists(args[1]) {
+			return nil, &ExitError{cmd, 1}
+		}
+		s.unit(args[1]).enabled = true
+	case len(args) == 2 && args[0] == "--del":
+		s.unit(args[1]).enabled = false
+	case len(args) == 2:
+		s.unit(args[0]).enabled = args[1] == "on"
+	case len(args) == 1:
+		if !s.unit(args[0]).enabled {
+			return nil, &ExitError{cmd, 1}
+		}
+	default:
+		return nil, &ExitError{cmd, 2}
+	}
+	return nil, nil
+}
+
+func (s *System) upstart(cmd, args []string) ([]byte, error) {
+	if len(args) != 1 || !s.exists(args[0]) {
+		return nil, &ExitError{cmd, 1}
+	}
+	name := args[0]
+	switch cmd[0] {
+	case "start":
+		s.start(name)
+	case "stop":
+		s.stop(name)
+	case "restart":
+		s.stop(name)
+		s.start(name)
+	case "status":
+		u := s.unit(name)
+		if !u.running {
+			return []byte(name + " stop/waiting\n"), nil
+		}
+		return []byte(fmt.Sprintf("%s start/running, process %d\n", name, u.pid)), nil
+	}
+	return nil, nil
+}
+
+func (s *System) rcService(cmd, args []string) ([]byte, error) {
+	if len(args) != 2 || !s.exists(args[0]) {
+		return nil, &ExitError{cmd, 1}
+	}
+	name := args[0]
+	switch args[1] {
+	case "start":
+		s.start(name)
+	case "stop":
+		s.stop(name)
+	case "restart":
+		s.stop(name)
+		s.start(name)
+	case "status":
+		if !s.unit(name).running {
+			return []byte(" * status: stopped\n"), &ExitError{cmd, 3}
+		}
+		return []byte(" * status: started\n"), nil
+	default:
+		return nil, &ExitError{cmd, 1}
+	}
+	return nil, nil
+}
+
+// rcUpdate adds and removes the runlevel links like rc-update
+func (s *System) rcUpdate(cmd, args []string) ([]byte, error) {
+	if len(args) != 3 || !s.exists(args[1]) {
+		return nil, &ExitError{cmd, 1}
+	}
+	link := filepath.Join(s.root, "etc/runlevels", args[2], args[1])
+	switch args[0] {
+	case "add":
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.Symlink("/etc/init.d/"+args[1], link); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	case "del":
+		if err := os.Remove(link); err != nil {
+			return nil, &ExitError{cmd, 1}
+		}
+	default:
+		return nil, &ExitError{cmd, 1}
+	}
+	return nil, nil
+}
+
+// sv controls the service directory args[1], a service that is not installed
+// has no runsv supervising it
+func (s *System) sv(cmd, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, &ExitError{cmd, 100}
+	}
+	dir := args[1]
+	name := filepath.Base(dir)
+	if !s.exists(name) {
+		return []byte("warning: " + dir + ": unable to open supervise/ok: file does not exist\n"), &ExitError{cmd, 1}
+	}
+	switch args[0] {
+	case "up":
+		s.start(name)
+	case "down", "exit":
+		s.stop(name)
+	case "restart":
+		s.stop(name)
+		s.start(name)
+	case "status":
+		if u := s.unit(name); u.running {
+			return []byte(fmt.Sprintf("run: %s: (pid %d) 1s\n", dir, u.pid)), nil
+		}
+		return []byte("down: " + dir + ": 1s\n"), nil
+	default:
+		return nil, &ExitError{cmd, 100}
+	}
+	return nil, nil
+}
+
+// s6 controls the service directory that is the last argument, a service
+// that is not installed has no s6-supervise. The fake services are ready as
+// soon as they are up.
+func (s *System) s6(cmd, args []string) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, &ExitError{cmd, 100}
+	}
+	dir := args[len(args)-1]
+	name := filepath.Base(dir)
+	if !s.exists(name) {
+		return []byte(cmd[0] + ": fatal: unable to control " + dir + ": supervisor not listening\n"), &ExitError{cmd, 111}
+	}
+	if cmd[0] == "s6-svstat" {
+		if u := s.unit(name); u.running {
+			return []byte(fmt.Sprintf("true true %d -1 NA\n", u.pid)), nil
+		}
+		return []byte("false false -1 0 NA\n"), nil
+	}
+	switch args[0] {
+	case "-u":
+		s.start(name)
+	case "-d":
+		s.stop(name)
+	case "-r":
+		s.stop(name)
+		s.start(name)
+	default:
+		return nil, &ExitError{cmd, 100}
+	}
+	return nil, nil
+}
+
+// autoStart reports whether the program file of name starts it with
+// supervisord
+func (s *System) autoStart(name string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "etc/supervisor/conf.d", name+".conf"))
+	return err == nil && strings.Contains(string(data), "\nautostart=true\n")
+}
+
+// supervisorctl knows the programs update loaded, update starts the ones
+// that start automatically
+func (s *System) supervisorctl(cmd, args []string) ([]byte, error) {
+	if len(args) == 1 && args[0] == "reread" {
+		return nil, nil
+	}
+	if len(args) != 2 {
+		return nil, &ExitError{cmd, 2}
+	}
+	name := args[1]
+	u := s.unit(name)
+	if args[0] == "update" {
+		switch {
+		case !s.exists(name):
+			s.stop(name)
+			u.loaded = false
+		case !u.loaded:
+			u.loaded = true
+			if s.autoStart(name) {
+				s.start(name)
+			}
+		}
+		return nil, nil
+	}
+	if !u.loaded {
+		return []byte(name + ": ERROR (no such process)\n"), &ExitError{cmd, 4}
+	}
+
+	switch args[0] {
+	case "start":
+		s.start(name)
+	case "stop":
+		s.stop(name)
+	case "restart":
+		s.stop(name)
+		s.start(name)
+	case "status":
+		switch {
+		case u.running:
+			return []byte(fmt.Sprintf("%s RUNNING pid %d, uptime 0:00:01\n", name, u.pid)), nil
+		case u.crash:
+			return []byte(name + " FATAL Exited too quickly (process log may have details)\n"), &ExitError{cmd, 3}
+		}
+		return []byte(name + " STOPPED Not started\n"), &ExitError{cmd, 3}
+	default:
+		return nil, &ExitError{cmd, 2}
+	}
+	return nil, nil
+}
+
+// updateRCD makes and renames the rc.d links like update-rc.d, with the
+// priorities of a script without dependencies
+func (s *System) updateRCD(cmd, args []string) ([]byte, error) {
+	if len(args) == 3 && args[0] == "-f" && args[2] == "remove" {
+		links, _ := filepath.Glob(filepath.Join(s.root, "etc/rc[0-6S].d/[SK][0-9][0-9]"+args[1]))
+		for _, link := range links {
+			os.Remove(link)
+		}
+		return nil, nil
+	}
+	if len(args) != 2 || !s.exists(args[0]) {
+		return nil, &ExitError{cmd, 1}
+	}
+
+	name := args[0]
+	for runlevel := 0; runlevel <= 6; runlevel++ {
+		dir := filepath.Join(s.root, fmt.Sprintf("etc/rc%d.d", runlevel))
+		start, stop := filepath.Join(dir, "S01"+name), filepath.Join(dir, "K01"+name)
+		switch {
+		case args[1] == "defaults":
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+			link := stop
+			if runlevel >= 2 && runlevel <= 5 {
+				link = start
+			}
+			os.Symlink("../init.d/"+name, link)
+		case runlevel < 2 || runlevel > 5:
+		case args[1] == "enable":
+			os.Rename(stop, start)
+		case args[1] == "disable":
+			os.Rename(start, stop)
+		default:
+			return nil, &ExitError{cmd, 1}
+		}
+	}
+	return nil, nil
+}